@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/snapbooks-app/peppol-lookup/go/internal/parallel"
+
+	"github.com/snapbooks-app/peppol-lookup/go/peppollookup"
+)
+
+// runWatch implements the "watch" command: it polls a participant's full
+// capabilities and prints a ChangeEvent for every change until ctx is
+// cancelled. The first poll is the baseline and reports nothing unless
+// the lookup fails.
+func runWatch(ctx context.Context, client *peppollookup.Client, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", 5*time.Minute, "time between polls")
+	asJSON := fs.Bool("json", false, "print each change as a JSON object on its own line")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("watch takes exactly one participant ID")
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+	id, err := peppollookup.ParseParticipantID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Every poll must see the SMP's current state
+	client.Cache = nil
+
+	emit := func(event peppollookup.ChangeEvent) {
+		event.Time = time.Now().UTC()
+		event.ParticipantID = id.String()
+		if *asJSON {
+			data, _ := json.Marshal(event)
+			fmt.Println(string(data))
+			return
+		}
+		line := fmt.Sprintf("%s %s %s", event.Time.Format(time.RFC3339), event.ParticipantID, event.Type)
+		for _, field := range []string{event.DocumentType, event.Process, event.TransportProfile, event.Detail} {
+			if field != "" {
+				line += " " + field
+			}
+		}
+		fmt.Println(line)
+	}
+
+	if !*asJSON {
+		fmt.Printf("Watching %s every %v; press Ctrl+C to stop\n", id, *interval)
+	}
+	var last *peppollookup.FullCapabilities
+	for first := true; ; first = false {
+		capabilities, err := client.FullCapabilities(ctx, id.ICD, id.Identifier)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, peppollookup.ErrNotRegistered) || errors.Is(err, peppollookup.ErrNoDocuments):
+			if !first {
+				for _, event := range peppollookup.DiffCapabilities(last, nil) {
+					emit(event)
+				}
+			}
+			last = nil
+		case err != nil:
+			emit(peppollookup.ChangeEvent{Type: "lookup_failed", Detail: err.Error()})
+		default:
+			if !first {
+				for _, event := range peppollookup.DiffCapabilities(last, capabilities) {
+					emit(event)
+				}
+			}
+			last = capabilities
+		}
+
+		select {
+		case <-time.After(*interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// doctorCheck is one item of the doctor command's checklist. run returns
+// a detail line for a passed check.
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// runDoctor implements the "doctor" command: it checks what lookups depend
+// on in this environment and prints a pass/fail checklist to w. It reports
+// whether every check passed.
+func runDoctor(ctx context.Context, client *peppollookup.Client, w io.Writer) bool {
+	healthICD, healthIdentifier, _ := strings.Cut(client.HealthCheckParticipant, ":")
+	checks := []doctorCheck{
+		{"Code lists", func(context.Context) (string, error) {
+			list := peppollookup.ListSchemes()
+			if len(list) == 0 {
+				return "", errors.New("no ICD schemes compiled in")
+			}
+			if _, ok := peppollookup.SchemeName("0192"); !ok {
+				return "", errors.New("ICD scheme 0192 is missing")
+			}
+			return fmt.Sprintf("%d ICD schemes loaded", len(list)), nil
+		}},
+		{"Proxy settings", func(context.Context) (string, error) {
+			if client.SOCKS5Proxy != "" {
+				proxyURL, err := client.SOCKS5ProxyURL()
+				if err != nil {
+					return "", err
+				}
+				return "all connections and DNS via " + proxyURL.Redacted(), nil
+			}
+			var details []string
+			for _, target := range []string{peppollookup.SMPHostURL("smp.example.com"), client.DirectoryURL} {
+				if target == "" {
+					continue
+				}
+				req, err := http.NewRequest(http.MethodGet, target, nil)
+				if err != nil {
+					return "", err
+				}
+				proxyURL, err := http.ProxyFromEnvironment(req)
+				if err != nil {
+					return "", fmt.Errorf("invalid proxy setting: %v", err)
+				}
+				via := "direct"
+				if proxyURL != nil {
+					via = "via " + proxyURL.Redacted()
+				}
+				details = append(details, req.URL.Scheme+" "+via)
+			}
+			return strings.Join(details, ", "), nil
+		}},
+		{"TLS trust store", func(context.Context) (string, error) {
+			if client.InsecureSkipVerify {
+				return "", errors.New("certificate verification is disabled (--insecure)")
+			}
+			if client.RootCAs != nil {
+				return "using the environment's root CAs", nil
+			}
+			if _, err := x509.SystemCertPool(); err != nil {
+				return "", fmt.Errorf("system root CAs unavailable: %v", err)
+			}
+			return "system root CAs found", nil
+		}},
+		{"SML DNS", func(ctx context.Context) (string, error) {
+			elapsed, err := client.CheckSMLHealth(ctx)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s answered in %v", client.SMLDomain, elapsed.Round(time.Millisecond)), nil
+		}},
+		{"Known SMP", func(ctx context.Context) (string, error) {
+			host, err := client.SMPHost(ctx, healthICD, healthIdentifier)
+			if err != nil {
+				return "", err
+			}
+			documentTypes, err := client.DocumentTypes(ctx, peppollookup.ParticipantID{ICD: healthICD, Identifier: healthIdentifier})
+			if err != nil {
+				return "", fmt.Errorf("SMP %s: %v", host, err)
+			}
+			return fmt.Sprintf("SMP %s of %s lists %d document types", host, client.HealthCheckParticipant, len(documentTypes)), nil
+		}},
+		{"PEPPOL Directory over HTTPS", func(ctx context.Context) (string, error) {
+			if client.DirectoryURL == "" {
+				return "no Directory configured, skipped", nil
+			}
+			if _, _, err := client.BusinessCard(ctx, healthICD, healthIdentifier); err != nil {
+				return "", err
+			}
+			return client.DirectoryURL + " answered", nil
+		}},
+	}
+
+	// Every check must reach the network, not the cache
+	client.Cache = nil
+
+	passed := true
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		detail, err := check.run(checkCtx)
+		cancel()
+		if err != nil {
+			passed = false
+			fmt.Fprintf(w, "%s %s: %v\n", red("[FAIL]"), check.name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", green("[PASS]"), check.name, detail)
+	}
+	return passed
+}
+
+// runDirectory implements the "directory" command: it prints what the
+// PEPPOL Directory has indexed for a participant and where that differs
+// from their SMP
+func runDirectory(ctx context.Context, client *peppollookup.Client, args []string) error {
+	fs := flag.NewFlagSet("directory", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the comparison as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("directory takes exactly one participant ID")
+	}
+	id, err := peppollookup.ParseParticipantID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	comparison, err := client.DirectoryLookupByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(comparison, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if !comparison.Indexed {
+		fmt.Printf("%s is not in the PEPPOL Directory\n", id)
+	} else {
+		fmt.Printf("PEPPOL Directory entry for %s:\n", id)
+		for _, entity := range comparison.Entities {
+			line := fmt.Sprintf("- %s (%s)", strings.Join(entity.Names, " / "), entity.Country)
+			if entity.RegistrationDate != "" {
+				line += ", registered " + entity.RegistrationDate
+			}
+			fmt.Println(line)
+		}
+	}
+	fmt.Printf("\nDocument types: %d in the Directory, %d on the SMP\n",
+		len(comparison.DocumentTypes), len(comparison.SMPDocumentTypes))
+	if len(comparison.NotInDirectory) > 0 {
+		fmt.Println(red("\nOn the SMP but not in the Directory:"))
+		for _, docType := range comparison.NotInDirectory {
+			fmt.Printf("- %s\n", docType)
+		}
+	}
+	if len(comparison.NotOnSMP) > 0 {
+		fmt.Println(red("\nIn the Directory but not on the SMP:"))
+		for _, docType := range comparison.NotOnSMP {
+			fmt.Printf("- %s\n", docType)
+		}
+	}
+	for _, warning := range comparison.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	return nil
+}
+
+// runOnboarding implements the "onboarding" command: it sorts participants
+// by whether they can receive BIS Billing 3.0 invoices and credit notes. It
+// reports whether every lookup completed.
+func runOnboarding(ctx context.Context, client *peppollookup.Client, args []string, concurrency int) (bool, error) {
+	fs := flag.NewFlagSet("onboarding", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	idFile := fs.String("file", "", "read participant IDs from this file, one per line (# starts a comment)")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	values := fs.Args()
+	if *idFile != "" {
+		data, err := os.ReadFile(*idFile)
+		if err != nil {
+			return false, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line, _, _ = strings.Cut(line, "#"); strings.TrimSpace(line) != "" {
+				values = append(values, strings.TrimSpace(line))
+			}
+		}
+	}
+	if len(values) == 0 {
+		return false, errors.New("onboarding needs participant IDs as arguments or in -file")
+	}
+	ids := make([]peppollookup.ParticipantID, 0, len(values))
+	for _, value := range values {
+		id, err := peppollookup.ParseParticipantID(value)
+		if err != nil {
+			return false, err
+		}
+		ids = append(ids, id)
+	}
+
+	report := client.OnboardingCheck(ctx, ids, concurrency)
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(string(data))
+	} else {
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "PARTICIPANT\tSTATUS\tNAME\tCOUNTRY")
+		for _, r := range report.Participants {
+			status := r.Status.Description()
+			if r.Status == peppollookup.OnboardingPartial && r.Invoice {
+				status += " (invoice only)"
+			} else if r.Status == peppollookup.OnboardingPartial {
+				status += " (credit note only)"
+			}
+			if r.Status == peppollookup.OnboardingReady {
+				status = green(status)
+			} else {
+				status = red(status)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", r.ParticipantID, status, r.Name, r.Country)
+			if r.Error != "" {
+				fmt.Fprintf(table, "\t%s\n", red("error: "+r.Error))
+			}
+			for _, warning := range r.Warnings {
+				fmt.Fprintf(table, "\t%s\n", red("warning: "+warning))
+			}
+		}
+		if err := table.Flush(); err != nil {
+			return false, err
+		}
+		fmt.Println()
+		for _, status := range peppollookup.OnboardingStatuses {
+			fmt.Printf("%s: %d\n", status.Description(), report.Summary[status])
+		}
+	}
+	return report.Summary[peppollookup.OnboardingError] == 0, nil
+}
+
+// runBench implements the hidden "bench" command: it repeatedly looks up
+// participants and reports throughput and latency percentiles. It queries
+// the test SML unless -env says otherwise.
+func runBench(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	total := fs.Int("n", 100, "total number of lookups")
+	concurrency := fs.Int("concurrency", 8, "lookups in flight at once")
+	envName := fs.String("env", "test", "environment to query: test or production")
+	rate := fs.Float64("rate", 0, "SMP requests per second (0 means unlimited)")
+	noCache := fs.Bool("no-cache", false, "disable the client cache")
+	mode := fs.String("mode", "lookup", "what to time: lookup, doctypes (DocumentTypes) or full (FullCapabilities)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *total < 1 || *concurrency < 1 {
+		return errors.New("-n and -concurrency must be at least 1")
+	}
+
+	env, ok := peppollookup.DefaultEnvironments[*envName]
+	if !ok {
+		return fmt.Errorf("unknown environment %q", *envName)
+	}
+	client := newClient()
+	if err := env.Apply(client); err != nil {
+		return err
+	}
+	client.RateLimit = *rate
+	client.DirectoryURL = ""
+	if *noCache {
+		client.Cache = nil
+	}
+
+	var run func(id peppollookup.ParticipantID) error
+	switch *mode {
+	case "lookup":
+		run = func(id peppollookup.ParticipantID) error {
+			_, err := client.Lookup(ctx, id.ICD, id.Identifier)
+			return err
+		}
+	case "doctypes":
+		run = func(id peppollookup.ParticipantID) error {
+			_, err := client.DocumentTypes(ctx, id)
+			return err
+		}
+	case "full":
+		run = func(id peppollookup.ParticipantID) error {
+			_, err := client.FullCapabilities(ctx, id.ICD, id.Identifier)
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", *mode)
+	}
+
+	// Count HTTP requests, which is what the modes differ in, on the
+	// client's own transport so its TLS and proxy settings still apply
+	var requests atomic.Int64
+	transport := client.Transport()
+	client.HTTPClient.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		return transport.RoundTrip(req)
+	})
+
+	ids := []peppollookup.ParticipantID{{ICD: "0192", Identifier: "921605900"}}
+	if fs.NArg() > 0 {
+		ids = ids[:0]
+		for _, arg := range fs.Args() {
+			id, err := peppollookup.ParseParticipantID(arg)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	fmt.Printf("Benchmarking %d %s calls for %d participant(s) against %s (%s), concurrency %d\n",
+		*total, *mode, len(ids), env.Name, env.SMLDomain, *concurrency)
+	latencies := make([]time.Duration, *total)
+	failed := make([]bool, *total)
+	start := time.Now()
+	parallel.ForEach(*total, *concurrency, func(i int) {
+		id := ids[i%len(ids)]
+		began := time.Now()
+		err := run(id)
+		latencies[i] = time.Since(began)
+		failed[i] = err != nil && !errors.Is(err, peppollookup.ErrNotRegistered) && !errors.Is(err, peppollookup.ErrNoDocuments)
+	})
+	elapsed := time.Since(start)
+
+	errorCount := 0
+	for _, f := range failed {
+		if f {
+			errorCount++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	fmt.Printf("Lookups:    %d (%d errors)\n", *total, errorCount)
+	fmt.Printf("Elapsed:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.1f lookups/s\n", float64(*total)/elapsed.Seconds())
+	fmt.Printf("Latency:    p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(0.50).Round(time.Microsecond), percentile(0.90).Round(time.Microsecond),
+		percentile(0.99).Round(time.Microsecond), latencies[len(latencies)-1].Round(time.Microsecond))
+	fmt.Printf("Requests:   %d HTTP (%.1f per lookup)\n", requests.Load(), float64(requests.Load())/float64(*total))
+	return nil
+}
+
+// roundTripperFunc adapts a function to an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// providerMapping is one row of a --provider-file: the SMP provider a
+// participant is expected to be on
+type providerMapping struct {
+	line     int
+	id       peppollookup.ParticipantID
+	expected string // SMP hostname or provider domain, e.g. "smp.example.com" or "example.com"
+}
+
+// readProviderFile parses a CSV of "participant-id,expected-provider" rows.
+// Lines starting with # are skipped, as is a header row.
+func readProviderFile(path string) ([]providerMapping, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var mappings []providerMapping
+	for first := true; ; first = false {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return mappings, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(row) != 2 || strings.TrimSpace(row[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"participant-id,expected-provider\"", path, line)
+		}
+		id, err := peppollookup.ParseParticipantID(strings.TrimSpace(row[0]))
+		if err != nil {
+			if first {
+				continue // header
+			}
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		mappings = append(mappings, providerMapping{line: line, id: id, expected: normalizeProvider(row[1])})
+	}
+}
+
+// normalizeProvider reduces an expected provider, which may be given as a
+// URL, to a lowercase hostname or domain
+func normalizeProvider(provider string) string {
+	provider = strings.ToLower(strings.TrimSpace(provider))
+	if u, err := url.Parse(provider); err == nil && u.Host != "" {
+		provider = u.Hostname()
+	}
+	return strings.TrimSuffix(provider, ".")
+}
+
+// onProvider reports whether the SMP host a participant resolves to is the
+// expected provider's host or lies within its domain
+func onProvider(actual, expected string) bool {
+	return actual == expected || strings.HasSuffix(actual, "."+expected)
+}
+
+// runProviderAudit resolves the SMP host of each participant in the CSV at
+// path and prints those not on their expected provider, with the host
+// they're on instead. It reports whether every participant matched.
+func runProviderAudit(ctx context.Context, client *peppollookup.Client, path string, concurrency int) (bool, error) {
+	mappings, err := readProviderFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	actual := make([]string, len(mappings))
+	errs := make([]error, len(mappings))
+	parallel.ForEach(len(mappings), concurrency, func(i int) {
+		actual[i], errs[i] = client.SMPHost(ctx, mappings[i].id.ICD, mappings[i].id.Identifier)
+	})
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PARTICIPANT\tEXPECTED\tACTUAL\tRESULT")
+	mismatches := 0
+	for i, m := range mappings {
+		var result string
+		switch err := errs[i]; {
+		case errors.Is(err, peppollookup.ErrNotRegistered):
+			result = "NOT REGISTERED"
+		case err != nil:
+			result = fmt.Sprintf("ERROR (%v)", err)
+		case !onProvider(actual[i], m.expected):
+			result = "MISMATCH"
+		default:
+			continue
+		}
+		mismatches++
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", m.id, m.expected, actual[i], red(result))
+	}
+	if mismatches == 0 {
+		fmt.Println(green(fmt.Sprintf("All %d participants are on their expected provider", len(mappings))))
+		return true, nil
+	}
+	if err := table.Flush(); err != nil {
+		return false, err
+	}
+	fmt.Printf("\n%d of %d participants are not on their expected provider\n", mismatches, len(mappings))
+	return false, nil
+}
@@ -0,0 +1,23 @@
+// Package parallel runs indexed work with bounded concurrency.
+package parallel
+
+import "sync"
+
+// ForEach calls fn(i) for every i in [0, n), running at most workers calls
+// at a time
+func ForEach(n, workers int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(workers, 1))
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
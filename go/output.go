@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/snapbooks-app/peppol-lookup/go/internal/parallel"
+
+	"github.com/snapbooks-app/peppol-lookup/go/peppollookup"
+)
+
+// record is one participant's lookup outcome in tabular and JSON output
+type record struct {
+	ID     peppollookup.ParticipantID
+	Result *peppollookup.Result // nil if the lookup failed
+	Err    error
+
+	// DocumentType is the --only-document-type asked about, if any. Result
+	// then lists only the matching document types.
+	DocumentType string
+}
+
+// registered reports whether the SML knows the participant, which holds
+// even when their SMP publishes nothing
+func (r record) registered() bool {
+	return r.Err == nil || errors.Is(r.Err, peppollookup.ErrNoDocuments)
+}
+
+// dnsName returns the SML name queried for the participant, if known
+func (r record) dnsName() string {
+	if r.Result != nil {
+		return r.Result.DNSName
+	}
+	var notFound *peppollookup.NotFoundError
+	if errors.As(r.Err, &notFound) {
+		return notFound.DNSName
+	}
+	return ""
+}
+
+// supports reports whether the result lists docType
+func (r record) supports(docType string) bool {
+	if r.Result == nil {
+		return false
+	}
+	for _, d := range r.Result.DocumentTypes {
+		if d == docType {
+			return true
+		}
+	}
+	return false
+}
+
+// outputFields renders each --fields column from a record
+var outputFields = map[string]func(r record) string{
+	"id":         func(r record) string { return r.ID.String() },
+	"registered": func(r record) string { return fmt.Sprint(r.registered()) },
+	"dns_name":   func(r record) string { return r.dnsName() },
+	"smp_host": func(r record) string {
+		if r.Result == nil {
+			return ""
+		}
+		return r.Result.SMPHostname
+	},
+	"invoice":     func(r record) string { return fmt.Sprint(r.supports(peppollookup.BISBillingInvoice)) },
+	"credit_note": func(r record) string { return fmt.Sprint(r.supports(peppollookup.BISBillingCreditNote)) },
+	"supported": func(r record) string {
+		if r.DocumentType == "" {
+			return ""
+		}
+		return fmt.Sprint(r.Result != nil && len(r.Result.DocumentTypes) > 0)
+	},
+	"name": func(r record) string {
+		if r.Result == nil {
+			return ""
+		}
+		return r.Result.Name
+	},
+	"country": func(r record) string {
+		if r.Result == nil {
+			return ""
+		}
+		return r.Result.Country
+	},
+	"document_types": func(r record) string {
+		if r.Result == nil {
+			return ""
+		}
+		return strings.Join(r.Result.DocumentTypes, " ")
+	},
+	"capabilities": func(r record) string {
+		if r.Result == nil {
+			return ""
+		}
+		return strings.Join(r.Result.Capabilities, "; ")
+	},
+	"metadata_references": func(r record) string {
+		if r.Result == nil {
+			return ""
+		}
+		return strings.Join(r.Result.MetadataReferences, " ")
+	},
+	"national_profiles": func(r record) string {
+		if r.Result == nil {
+			return ""
+		}
+		names := make([]string, len(r.Result.NationalProfiles))
+		for i, profile := range r.Result.NationalProfiles {
+			names[i] = profile.Name
+		}
+		return strings.Join(names, "; ")
+	},
+	"error": func(r record) string {
+		if r.Err == nil || r.registered() || errors.Is(r.Err, peppollookup.ErrNotRegistered) {
+			return ""
+		}
+		return r.Err.Error()
+	},
+}
+
+// defaultFields are printed when --fields is not given
+var defaultFields = []string{"id", "registered", "smp_host", "invoice", "credit_note"}
+
+// documentTypeFields are printed with --only-document-type when --fields
+// is not given
+var documentTypeFields = []string{"id", "registered", "supported"}
+
+// parseFields validates a comma-separated --fields value
+func parseFields(value string) ([]string, error) {
+	if value == "" {
+		return defaultFields, nil
+	}
+	var fields []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := outputFields[name]; !ok {
+			known := make([]string, 0, len(outputFields))
+			for field := range outputFields {
+				known = append(known, field)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown field %q (known fields: %s)", name, strings.Join(known, ", "))
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+// defaultConcurrency is the default number of participants looked up at
+// once in batch mode
+func defaultConcurrency() int {
+	return min(runtime.NumCPU()*4, 64)
+}
+
+// lookupAll looks up the participants, up to concurrency at a time, and
+// returns the records in the order of ids
+func lookupAll(ctx context.Context, client *peppollookup.Client, ids []peppollookup.ParticipantID, concurrency int) []record {
+	records := make([]record, len(ids))
+	parallel.ForEach(len(ids), concurrency, func(i int) {
+		result, err := client.Lookup(ctx, ids[i].ICD, ids[i].Identifier)
+		records[i] = record{ID: ids[i], Result: result, Err: err}
+	})
+	return records
+}
+
+// documentTypeFilter returns a matcher for an --only-document-type value:
+// a full document identifier, a "namespace::local name" that matches any
+// customization, or just a UBL root element such as "Catalogue"
+func documentTypeFilter(value string) (func(docType string) bool, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "::") {
+		return func(docType string) bool { return peppollookup.DocumentTypeMatches(docType, value) }, nil
+	}
+	rootNamespace, err := peppollookup.UBLRootNamespace(value)
+	if err != nil {
+		return nil, err
+	}
+	want := rootNamespace + "::" + value
+	return func(docType string) bool { return peppollookup.DocumentTypeMatches(docType, want) }, nil
+}
+
+// lookupDocumentType is lookupAll for --only-document-type: only the SML
+// and each participant's ServiceGroup are queried, skipping ServiceMetadata,
+// the Directory and business cards, and only the matching document types
+// are kept
+func lookupDocumentType(ctx context.Context, client *peppollookup.Client, ids []peppollookup.ParticipantID, concurrency int, documentType string, matches func(string) bool) []record {
+	records := make([]record, len(ids))
+	parallel.ForEach(len(ids), concurrency, func(i int) {
+		r := record{ID: ids[i], DocumentType: documentType}
+		documentTypes, err := client.DocumentTypes(ctx, ids[i])
+		if err != nil {
+			r.Err = err
+		} else {
+			r.Result = &peppollookup.Result{ParticipantID: ids[i].String(), DNSName: client.DNSName(ids[i].ICD, ids[i].Identifier), DocumentTypes: []string{}}
+			for _, docType := range documentTypes {
+				if matches(docType.Raw) {
+					r.Result.DocumentTypes = append(r.Result.DocumentTypes, docType.Raw)
+				}
+			}
+		}
+		records[i] = r
+	})
+	return records
+}
+
+// appendMsgpackString appends s as a MessagePack str
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackStrings appends ss as a MessagePack array of str
+func appendMsgpackStrings(b []byte, ss []string) []byte {
+	if n := len(ss); n < 16 {
+		b = append(b, 0x90|byte(n))
+	} else {
+		b = binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+	for _, s := range ss {
+		b = appendMsgpackString(b, s)
+	}
+	return b
+}
+
+// appendMsgpackRecord appends r as a MessagePack map. The schema is stable:
+// every record has the same nine keys in this order, with the same
+// meaning as in JSON output, and empty strings or arrays where a value is
+// absent.
+//
+//	participant_id  str
+//	registered      bool
+//	error           str
+//	smp_hostname    str
+//	document_types  array of str
+//	capabilities    array of str
+//	name            str
+//	country         str
+//	warnings        array of str
+func appendMsgpackRecord(b []byte, r record) []byte {
+	result := r.Result
+	if result == nil {
+		result = &peppollookup.Result{}
+	}
+	errText := ""
+	if r.Err != nil {
+		errText = r.Err.Error()
+	}
+	registered := byte(0xc2)
+	if r.registered() {
+		registered = 0xc3
+	}
+
+	b = append(b, 0x80|9)
+	b = appendMsgpackString(b, "participant_id")
+	b = appendMsgpackString(b, r.ID.String())
+	b = appendMsgpackString(b, "registered")
+	b = append(b, registered)
+	b = appendMsgpackString(b, "error")
+	b = appendMsgpackString(b, errText)
+	b = appendMsgpackString(b, "smp_hostname")
+	b = appendMsgpackString(b, result.SMPHostname)
+	b = appendMsgpackString(b, "document_types")
+	b = appendMsgpackStrings(b, result.DocumentTypes)
+	b = appendMsgpackString(b, "capabilities")
+	b = appendMsgpackStrings(b, result.Capabilities)
+	b = appendMsgpackString(b, "name")
+	b = appendMsgpackString(b, result.Name)
+	b = appendMsgpackString(b, "country")
+	b = appendMsgpackString(b, result.Country)
+	b = appendMsgpackString(b, "warnings")
+	return appendMsgpackStrings(b, result.Warnings)
+}
+
+// writeRecords prints records as an aligned text table, CSV, JSON Lines or
+// a stream of MessagePack maps. fields selects the text and CSV columns.
+func writeRecords(w io.Writer, records []record, format string, fields []string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		for _, r := range records {
+			out := struct {
+				ParticipantID string `json:"participant_id"`
+				Registered    bool   `json:"registered"`
+				Error         string `json:"error,omitempty"`
+				DNSName       string `json:"dns_name,omitempty"`
+				DocumentType  string `json:"only_document_type,omitempty"`
+				Supported     *bool  `json:"supported,omitempty"`
+				*peppollookup.Result
+			}{ParticipantID: r.ID.String(), Registered: r.registered(), DNSName: r.dnsName(), Result: r.Result}
+			if r.Err != nil {
+				out.Error = r.Err.Error()
+			}
+			if r.DocumentType != "" {
+				supported := r.Result != nil && len(r.Result.DocumentTypes) > 0
+				out.DocumentType, out.Supported = r.DocumentType, &supported
+			}
+			if err := encoder.Encode(out); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "msgpack":
+		// MessagePack values are self-delimiting, so records are simply
+		// concatenated
+		for _, r := range records {
+			if _, err := w.Write(appendMsgpackRecord(nil, r)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(fields)
+		for _, r := range records {
+			row := make([]string, len(fields))
+			for i, field := range fields {
+				row[i] = outputFields[field](r)
+			}
+			writer.Write(row)
+		}
+		writer.Flush()
+		return writer.Error()
+
+	default:
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, strings.ToUpper(strings.Join(fields, "\t")))
+		for _, r := range records {
+			row := make([]string, len(fields))
+			for i, field := range fields {
+				row[i] = outputFields[field](r)
+			}
+			fmt.Fprintln(table, strings.Join(row, "\t"))
+		}
+		return table.Flush()
+	}
+}
@@ -1,159 +1,388 @@
+// Command peppol-lookup looks up PEPPOL participants from the command line.
+// It's a thin CLI over the peppollookup package, which uses SML to find where
+// a participant's metadata is hosted and queries their SMP to discover what
+// documents they can receive.
 package main
 
-/*
-PEPPOL uses two key services to enable document exchange:
-
-1. SML (Service Metadata Locator):
-   - Acts as a DNS-based directory service
-   - Maps a participant's ID to their SMP provider
-   - Uses DNS lookup to find where a participant's metadata is hosted
-   - Similar to how email's MX records help find mail servers
-
-2. SMP (Service Metadata Publisher):
-   - Hosts metadata about a participant's capabilities
-   - Tells you what document types they can receive
-   - Provides technical details needed for sending documents
-   - Acts like a participant's business card in the network
-
-This example demonstrates how to:
-1. Use SML to find where a participant's metadata is hosted
-2. Query their SMP to discover what documents they can receive
-3. Check for PEPPOL BIS Billing 3.0 support
-*/
-
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"regexp"
-	"strings"
-)
-
-// Test environment SML domain
-const smlDomain = "edelivery.tech.ec.europa.eu"
+	"os/signal"
+	"runtime/debug"
+	"time"
 
-// PEPPOL BIS Billing 3.0 document identifiers
-const (
-	bisBillingInvoice    = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2::Invoice"
-	bisBillingCreditNote = "urn:oasis:names:specification:ubl:schema:xsd:CreditNote-2::CreditNote"
+	"github.com/snapbooks-app/peppol-lookup/go/peppollookup"
 )
 
-// smlLookup performs SML lookup using DNS lookup
+// Build information, set at build time with e.g.
 //
-// The SML is like a phone book for the PEPPOL network. Given a participant's ID:
-// 1. Create an MD5 hash of their ID (e.g., "0192:921605900")
-// 2. Use the hash to construct a DNS hostname
-// 3. If the hostname exists, the participant is registered in PEPPOL
-// 4. The hostname tells us where to find their metadata (SMP)
-//
-// Returns the SMP hostname if found, empty string if not found
-func smlLookup(icd, identifier string) string {
-	// Create MD5 hash of participant ID
-	participantID := fmt.Sprintf("%s:%s", icd, identifier)
-	hash := md5.Sum([]byte(participantID))
-	md5Hash := hex.EncodeToString(hash[:])
-
-	// Construct hostname
-	hostname := fmt.Sprintf("b-%s.iso6523-actorid-upis.%s", md5Hash, smlDomain)
-
-	// Check if hostname exists
-	_, err := net.LookupHost(hostname)
-	if err != nil {
-		return ""
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo returns the version, commit and build date, falling back to the
+// module and VCS information Go embeds in the binary when ldflags aren't set
+func buildInfo() (v, rev, date string) {
+	v, rev, date = version, commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
 	}
-	return hostname
+	if v == "" {
+		v = "dev"
+	}
+	return v, rev, date
 }
 
-// smpLookup gets supported document identifiers from SMP
-//
-// The SMP is like a business card in the PEPPOL network. It tells us:
-// 1. What types of documents the participant can receive
-// 2. Technical details needed for sending documents
-// 3. Specific document format versions they support
-//
-// This is similar to how DNS MX records tell you where to send email,
-// but SMP also includes what "types" of messages you can send.
-func smpLookup(smpHostname, icd, identifier string) ([]string, error) {
-	// Construct SMP URL
-	// Format: http://[SMP hostname]/[identifier scheme]::[participant identifier]
-	participantID := fmt.Sprintf("%s:%s", icd, identifier)
-	urlStr := fmt.Sprintf("http://%s/iso6523-actorid-upis::%s",
-		smpHostname,
-		url.QueryEscape(participantID))
-
-	// Perform HTTP GET request
-	resp, err := http.Get(urlStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch SMP data: %v", err)
+// newClient returns a Client identifying this build in its User-Agent
+func newClient() *peppollookup.Client {
+	client := peppollookup.NewClient()
+	v, _, _ := buildInfo()
+	client.UserAgent = "peppol-lookup/" + v
+	return client
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [participant-id ...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s schemes\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] onboarding [-json] [-file=ids.txt] [participant-id ...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] watch [-interval=5m] [-json] participant-id\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Looks up 0192:921605900 (Snapbooks AS) when no participant ID is given.")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	dumpPath := flag.String("dump", "", "write the participant's full capabilities as JSON to this file")
+	participantFile := flag.String("participant-file", "", "check \"participant-id expected-document-type\" lines from this file and exit non-zero if any fail")
+	snapshotDir := flag.String("snapshot-dir", "", "save each lookup result as a timestamped JSON snapshot in this directory")
+	offline := flag.Bool("offline", false, "read the latest snapshot from --snapshot-dir instead of querying the network")
+	smlOnly := flag.Bool("sml-only", false, "only check SML registration and skip the SMP query")
+	format := flag.String("format", "text", "output format: text, csv, json or msgpack")
+	fieldList := flag.String("fields", "", "comma-separated columns for text and csv output, e.g. id,registered,smp_host,invoice")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	configPath := flag.String("config", "", "JSON file defining named environments for --env-name")
+	envName := flag.String("env-name", "", "environment to query: production, test or one defined in --config")
+	debugDNS := flag.Bool("debug", false, "print the full DNS answers and CNAME chain for each participant's SML names and the SMP's TLS certificates")
+	smpHost := flag.String("smp-host", "", "query this SMP host directly, skipping the SML lookup")
+	concurrency := flag.Int("concurrency", defaultConcurrency(), "number of participants looked up at once in batch mode")
+	companyName := flag.String("name", "", "search the PEPPOL Directory for this company name and look up the best matches")
+	providerFile := flag.String("provider-file", "", "check a CSV of \"participant-id,expected-SMP-provider\" rows and report participants on another provider")
+	checkStructure := flag.Bool("check-structure", false, "reject SMP responses whose element structure deviates from the SMP schema; a structural check, not XSD validation")
+	maxDocTypes := flag.Int("max-doctypes", 500, "fetch at most this many document types' metadata in every full-capabilities fetch: --dump, --check-endpoints, watch, report and onboarding (0 means unlimited)")
+	requireDNSSEC := flag.Bool("require-dnssec", false, "fail unless the DNS resolver sets the AD bit on SML answers (signatures are not validated locally)")
+	forceHTTP1 := flag.Bool("http1", false, "use HTTP/1.1 even with SMPs that support HTTP/2")
+	checkNAPTR := flag.Bool("check-naptr", false, "also query each participant's NAPTR record and warn if it points to another SMP than the CNAME")
+	enrich := flag.Bool("enrich", false, "add each participant's name and country from the PEPPOL Directory or their SMP's business card")
+	checkEndpoints := flag.Bool("check-endpoints", false, "connect to each access point endpoint (TCP and TLS handshake, no message sent) and fail if any is unreachable")
+	negativeCacheTTL := flag.Duration("negative-cache-ttl", 5*time.Minute, "how long to remember that a participant isn't registered (0 disables)")
+	socks5Proxy := flag.String("socks5", "", "tunnel connections and DNS queries through this SOCKS5 proxy, e.g. localhost:1080")
+	dnsServer := flag.String("dns-server", "", "DNS server (host:port) for SML queries, e.g. 1.1.1.1:53 when using --socks5")
+	caseFallback := flag.Bool("case-fallback", false, "if a participant isn't registered under their lowercased ID, also try the ID as typed")
+	auditLog := flag.String("audit-log", "", "append a JSON Lines audit record of every lookup to this file")
+	maxRedirects := flag.Int("max-redirects", 10, "most HTTP redirects to follow per SMP request")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification (debugging only; SMP answers can be forged)")
+	retryOnEmpty := flag.Int("retry-on-empty", 0, "retry an SMP that publishes no document types this many times, 5s apart")
+	onlyRegistered := flag.Bool("only-registered", false, "in batch output, only list participants registered in the SML")
+	onlyUnregistered := flag.Bool("only-unregistered", false, "in batch output, only list participants not registered in the SML")
+	onlyDocumentType := flag.String("only-document-type", "", "only report whether each participant supports this document type: a full ID, namespace::name, or a UBL root element such as Catalogue")
+	flag.Parse()
+
+	if *showVersion {
+		v, rev, date := buildInfo()
+		fmt.Printf("peppol-lookup %s\n", v)
+		if rev != "" {
+			fmt.Printf("commit: %s\n", rev)
+		}
+		if date != "" {
+			fmt.Printf("built: %s\n", date)
+		}
+		return
 	}
-	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	if *format != "text" && *format != "csv" && *format != "json" && *format != "msgpack" {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q\n", *format)
+		os.Exit(2)
+	}
+	fields, err := parseFields(*fieldList)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --concurrency must be at least 1")
+		os.Exit(2)
 	}
 
-	// Extract document types from ServiceMetadataReference href attributes
-	documentTypes := make([]string, 0)
+	if flag.Arg(0) == "bench" {
+		if err := runBench(context.Background(), flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		return
+	}
 
-	// Match ServiceMetadataReference href attributes
-	re := regexp.MustCompile(`ServiceMetadataReference[^>]*href="([^"]*)"[^>]*>`)
-	matches := re.FindAllStringSubmatch(string(body), -1)
+	if flag.Arg(0) == "schemes" {
+		if err := printSchemes(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	for _, match := range matches {
-		href, err := url.QueryUnescape(match[1])
+	ctx := context.Background()
+	client := newClient()
+	client.EmptyRetries = *retryOnEmpty
+	client.DebugDNS = *debugDNS
+	if *debugDNS {
+		client.MaxCNAMEDepth = peppollookup.DefaultMaxCNAMEDepth
+	}
+	client.RequireDNSSEC = *requireDNSSEC
+	client.ForceHTTP1 = *forceHTTP1
+	client.CaseFallback = *caseFallback
+	client.EnrichResults = *enrich
+	client.CheckSMLConsistency = *checkNAPTR
+	client.DNSServer = *dnsServer
+	client.NegativeCacheTTL = *negativeCacheTTL
+	client.SOCKS5Proxy = *socks5Proxy
+	if client.SOCKS5Proxy != "" {
+		if _, err := client.SOCKS5ProxyURL(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
 		if err != nil {
-			continue
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		client.AuditLog = f
+	}
+	client.MaxRedirects = *maxRedirects
+	if *insecure {
+		client.InsecureSkipVerify = true
+		fmt.Fprintln(os.Stderr, red("WARNING: --insecure is set: TLS certificates are NOT verified and SMP answers may be forged. Never use this for production decisions."))
+	}
+	client.MaxDocumentTypes = *maxDocTypes
+	client.CheckStructure = *checkStructure
+
+	if *envName != "" {
+		environments := peppollookup.DefaultEnvironments
+		if *configPath != "" {
+			var err error
+			if environments, err = peppollookup.LoadEnvironments(*configPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		env, ok := environments[*envName]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown environment %q\n", *envName)
+			os.Exit(2)
 		}
-		if strings.Contains(href, "busdox-docid-qns::") {
-			parts := strings.Split(href, "busdox-docid-qns::")[1]
-			docType := strings.Split(parts, "#")[0]
-			documentTypes = append(documentTypes, docType)
+		if err := env.Apply(client); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
 		}
 	}
 
-	return documentTypes, nil
-}
+	if flag.Arg(0) == "doctor" {
+		if !runDoctor(ctx, client, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
 
-func main() {
-	// Snapbooks AS (Norwegian organization number)
-	icd := "0192"
-	identifier := "921605900"
+	if flag.Arg(0) == "directory" {
+		if err := runDirectory(ctx, client, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Step 1: Use SML to find where participant's metadata is hosted
-	smpHostname := smlLookup(icd, identifier)
-	if smpHostname == "" {
-		fmt.Printf("Not a PEPPOL participant: %s:%s\n", icd, identifier)
-		os.Exit(1)
+	if flag.Arg(0) == "onboarding" {
+		complete, err := runOnboarding(ctx, client, flag.Args()[1:], *concurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if !complete {
+			os.Exit(1)
+		}
+		return
 	}
-	fmt.Printf("SMP hostname: %s\n", smpHostname)
 
-	// Step 2: Query their SMP to discover supported documents
-	documentTypes, err := smpLookup(smpHostname, icd, identifier)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if flag.Arg(0) == "watch" {
+		watchCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		if err := runWatch(watchCtx, client, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *participantFile != "" {
+		passed, err := runAssertions(ctx, client, *participantFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *providerFile != "" {
+		matched, err := runProviderAudit(ctx, client, *providerFile, *concurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !matched {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *companyName != "" {
+		reports, err := client.ResolveByName(ctx, *companyName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := printNameMatches(os.Stdout, reports); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *offline && *snapshotDir == "" {
+		fmt.Fprintln(os.Stderr, "Error: --offline requires --snapshot-dir")
+		os.Exit(2)
+	}
+	if *smpHost != "" && (*offline || *smlOnly || *format != "text" || *fieldList != "") {
+		fmt.Fprintln(os.Stderr, "Error: --smp-host can't be combined with --offline, --sml-only, --format or --fields")
+		os.Exit(2)
+	}
+	filter := showAll
+	switch {
+	case *onlyRegistered && *onlyUnregistered:
+		fmt.Fprintln(os.Stderr, "Error: --only-registered and --only-unregistered are mutually exclusive")
+		os.Exit(2)
+	case *onlyRegistered:
+		filter = showRegistered
+	case *onlyUnregistered:
+		filter = showUnregistered
+	}
+	if *checkEndpoints && (*offline || *smlOnly || *onlyDocumentType != "") {
+		fmt.Fprintln(os.Stderr, "Error: --check-endpoints can't be combined with --offline, --sml-only or --only-document-type")
+		os.Exit(2)
+	}
+	var matchesDocumentType func(string) bool
+	if *onlyDocumentType != "" {
+		if *offline || *smlOnly || *smpHost != "" || *dumpPath != "" {
+			fmt.Fprintln(os.Stderr, "Error: --only-document-type can't be combined with --offline, --sml-only, --smp-host or --dump")
+			os.Exit(2)
+		}
+		if matchesDocumentType, err = documentTypeFilter(*onlyDocumentType); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --only-document-type: %v\n", err)
+			os.Exit(2)
+		}
+		if *fieldList == "" {
+			fields = documentTypeFields
+		}
+	}
+	if filter != showAll && !*smlOnly && *format == "text" && *fieldList == "" && *onlyDocumentType == "" {
+		fmt.Fprintln(os.Stderr, "Error: --only-registered and --only-unregistered require --sml-only, --format, --fields or --only-document-type")
+		os.Exit(2)
+	}
+
+	// Snapbooks AS (Norwegian organization number)
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"0192:921605900"}
+	}
+	ids := make([]peppollookup.ParticipantID, 0, len(args))
+	for _, arg := range args {
+		id, err := peppollookup.ParseParticipantID(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		ids = append(ids, id)
 	}
 
-	fmt.Println("\nSupported document identifiers:")
-	for _, docType := range documentTypes {
-		fmt.Printf("- %s\n", docType)
+	client.SMLOnly = *smlOnly
+
+	// Tabular output: one row per participant
+	if *format != "text" || *fieldList != "" || *onlyDocumentType != "" {
+		var records []record
+		if matchesDocumentType != nil {
+			records = lookupDocumentType(ctx, client, ids, *concurrency, *onlyDocumentType, matchesDocumentType)
+		} else {
+			records = lookupAll(ctx, client, ids, *concurrency)
+		}
+		if err := writeRecords(os.Stdout, filterRecords(records, filter), *format, fields); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		var failures []record
+		for _, r := range records {
+			printProductionWarning(os.Stderr, r.Err)
+			if r.Err != nil && !r.registered() && !errors.Is(r.Err, peppollookup.ErrNotRegistered) {
+				failures = append(failures, r)
+			}
+		}
+		if !printBatchSummary(os.Stderr, len(records), failures) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *smlOnly {
+		failures := printRegistrations(ctx, client, ids, *concurrency, filter)
+		if !printBatchSummary(os.Stderr, len(ids), failures) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Check for PEPPOL BIS Billing 3.0 documents
-	fmt.Println("\nPEPPOL BIS Billing 3.0 Support:")
-	for _, docType := range documentTypes {
-		switch docType {
-		case bisBillingInvoice:
-			fmt.Println("- Supports Invoice")
-		case bisBillingCreditNote:
-			fmt.Println("- Supports Credit Note")
+	if *smpHost != "" {
+		if err := client.CheckSMPHostReachable(ctx, *smpHost); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
 	}
+
+	opts := cliOptions{dumpPath: *dumpPath, snapshotDir: *snapshotDir, offline: *offline, smpHost: *smpHost, checkEndpoints: *checkEndpoints}
+	// Keep going after a failed lookup; the summary lists every failure
+	workers := *concurrency
+	if opts.dumpPath != "" {
+		// Every lookup writes the same --dump file
+		workers = 1
+	}
+	failures := printLookups(ctx, client, ids, workers, opts)
+	if !printBatchSummary(os.Stderr, len(ids), failures) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,120 @@
+package peppollookup
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// MemoryCache is the built-in in-process Cache
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+// NewMemoryCache returns an empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]memoryCacheEntry)}
+}
+
+// Get implements Cache
+func (m *MemoryCache) Get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(m.entries, key)
+		return "", false
+	}
+	return entry.value, true
+}
+
+// Delete implements Cache
+func (m *MemoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
+
+// Set implements Cache
+func (m *MemoryCache) Set(key, value string, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = memoryCacheEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+// cachedResult is a Lookup result as stored in Cache
+type cachedResult struct {
+	Fetched time.Time `json:"fetched"`
+	Result  *Result   `json:"result"`
+}
+
+// cacheResult stores a Lookup result for ResultHardTTL
+func (c *Client) cacheResult(cacheKey string, result *Result) {
+	value, err := json.Marshal(cachedResult{Fetched: time.Now(), Result: result})
+	if err == nil {
+		c.Cache.Set(cacheKey, string(value), c.ResultHardTTL)
+	}
+}
+
+// refreshInBackground re-runs a lookup whose cached result is stale,
+// unless a refresh for it is already running. Failed refreshes leave the
+// cached result in place until it expires.
+func (c *Client) refreshInBackground(ctx context.Context, cacheKey, icd, identifier string) {
+	c.state.mu.Lock()
+	if c.state.refreshing[cacheKey] {
+		c.state.mu.Unlock()
+		return
+	}
+	if c.state.refreshing == nil {
+		c.state.refreshing = make(map[string]bool)
+	}
+	c.state.refreshing[cacheKey] = true
+	c.state.mu.Unlock()
+
+	// The refresh outlives the request that triggered it
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() {
+			c.state.mu.Lock()
+			delete(c.state.refreshing, cacheKey)
+			c.state.mu.Unlock()
+		}()
+		if result, err := c.lookup(ctx, icd, identifier); err == nil {
+			c.cacheResult(cacheKey, result)
+		}
+	}()
+}
+
+// resultCacheKey is the Cache key of a participant's Lookup result. It
+// includes the participant's SML hostname, so results from different SMLs
+// or schemes (see WithEnvironment) are kept apart, and whether the result is
+// SML-only.
+func (c *Client) resultCacheKey(icd, identifier string, smlOnly bool) string {
+	key := "result:" + c.participantHostname(icd, identifier)
+	if smlOnly {
+		key += ":sml-only"
+	}
+	return key
+}
+
+// Invalidate removes everything cached about a participant, so the next
+// lookup queries the SML and SMP again, e.g. right after they've registered
+func (c *Client) Invalidate(icd, identifier string) {
+	if c.Cache == nil {
+		return
+	}
+	c.Cache.Delete("sml:" + c.participantHostname(icd, identifier))
+	c.Cache.Delete("sml-nxdomain:" + c.participantHostname(icd, identifier))
+	c.Cache.Delete(c.resultCacheKey(icd, identifier, false))
+	c.Cache.Delete(c.resultCacheKey(icd, identifier, true))
+}
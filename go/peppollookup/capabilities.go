@@ -0,0 +1,537 @@
+package peppollookup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/snapbooks-app/peppol-lookup/go/internal/parallel"
+)
+
+// FullCapabilities is everything a participant's SMP publishes
+type FullCapabilities struct {
+	ParticipantID string            `json:"participant_id"`
+	SMPHostname   string            `json:"smp_hostname"`
+	Services      []ServiceMetadata `json:"services"`
+	SMPVersion    string            `json:"smp_version"`        // "1.0" or "2.0"
+	Errors        []string          `json:"errors,omitempty"`   // documents skipped as malformed
+	Warnings      []string          `json:"warnings,omitempty"` // e.g. document types left out by MaxDocumentTypes
+
+	// ByProcess groups the document types of Services by the process
+	// identifiers their metadata lists, e.g. the BIS Billing 3.0 process
+	// "urn:fdc:peppol.eu:2017:poacc:billing:01:1.0"
+	ByProcess map[string][]DocumentType `json:"by_process"`
+}
+
+// DocumentTypes lists the document identifiers of all services
+func (f *FullCapabilities) DocumentTypes() []string {
+	documentTypes := make([]string, 0, len(f.Services))
+	for _, service := range f.Services {
+		documentTypes = append(documentTypes, service.DocumentType)
+	}
+	return documentTypes
+}
+
+// Supports reports whether the participant receives docType
+//
+// docType may be a full document identifier or just its root namespace and
+// local name (e.g. BISBillingInvoice), which matches any customization.
+func (f *FullCapabilities) Supports(docType string) bool {
+	for _, service := range f.Services {
+		if DocumentTypeMatches(service.DocumentType, docType) {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsMatcher reports whether any of the participant's document types
+// matches m, e.g. MatchBISOrder
+func (f *FullCapabilities) SupportsMatcher(m DocumentMatcher) bool {
+	for _, service := range f.Services {
+		if m.Matches(ParseDocumentType(service.DocumentType)) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransportProfiles returns the distinct transport profiles of all the
+// participant's endpoints, sorted, e.g. ["peppol-transport-as4-v2_0"]
+func (f *FullCapabilities) TransportProfiles() []string {
+	seen := make(map[string]bool)
+	for _, service := range f.Services {
+		for _, process := range service.Processes {
+			for _, endpoint := range process.Endpoints {
+				if endpoint.TransportProfile != "" {
+					seen[string(endpoint.TransportProfile)] = true
+				}
+			}
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// NationalProfiles returns the national profiles the participant's document
+// types belong to, e.g. EHF Invoice 2.0
+func (f *FullCapabilities) NationalProfiles() []NationalProfile {
+	return SupportedNationalProfiles(f.DocumentTypes())
+}
+
+// DocumentTypeMatches reports whether the full document identifier
+// published by an SMP matches want, which may omit the customization part
+func DocumentTypeMatches(published, want string) bool {
+	return published == want || strings.HasPrefix(published, want+"##")
+}
+
+// DocumentType is a parsed PEPPOL document identifier of the form
+// <root namespace>::<local name>##<customization ID>::<version>
+type DocumentType struct {
+	RootNamespace   string `json:"root_namespace"`   // e.g. "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	LocalName       string `json:"local_name"`       // e.g. "Invoice"
+	CustomizationID string `json:"customization_id"` // e.g. "urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0"
+	Version         string `json:"version"`          // e.g. "2.1"
+	Raw             string `json:"raw"`              // the identifier as published
+}
+
+// ParseDocumentType splits a document identifier into its parts. Parts that
+// are absent, such as the customization of a bare "namespace::name", are
+// left empty.
+func ParseDocumentType(id string) DocumentType {
+	docType := DocumentType{Raw: id}
+	syntax, customization, _ := strings.Cut(id, "##")
+	if i := strings.LastIndex(syntax, "::"); i >= 0 {
+		docType.RootNamespace, docType.LocalName = syntax[:i], syntax[i+2:]
+	} else {
+		docType.RootNamespace = syntax
+	}
+	if i := strings.LastIndex(customization, "::"); i >= 0 {
+		docType.CustomizationID, docType.Version = customization[:i], customization[i+2:]
+	} else {
+		docType.CustomizationID = customization
+	}
+	return docType
+}
+
+// DocumentMatcher recognizes a capability among a participant's document types
+type DocumentMatcher interface {
+	Matches(DocumentType) bool
+}
+
+// DocumentMatcherFunc adapts a function to a DocumentMatcher
+type DocumentMatcherFunc func(DocumentType) bool
+
+// Matches implements DocumentMatcher
+func (f DocumentMatcherFunc) Matches(d DocumentType) bool { return f(d) }
+
+// documentTypeMatcher matches a UBL document type, optionally restricted to
+// customization IDs starting with a given prefix
+type documentTypeMatcher struct {
+	rootNamespace       string
+	localName           string
+	customizationPrefix string
+}
+
+// matcherFor returns a matcher for the document type and customization of
+// the full document identifier id, accepting any version
+func matcherFor(id string) documentTypeMatcher {
+	d := ParseDocumentType(id)
+	return documentTypeMatcher{d.RootNamespace, d.LocalName, d.CustomizationID}
+}
+
+func (m documentTypeMatcher) Matches(d DocumentType) bool {
+	return d.RootNamespace == m.rootNamespace && d.LocalName == m.localName &&
+		strings.HasPrefix(d.CustomizationID, m.customizationPrefix)
+}
+
+// Built-in capability matchers
+var (
+	MatchBISBillingInvoice DocumentMatcher = documentTypeMatcher{
+		"urn:oasis:names:specification:ubl:schema:xsd:Invoice-2", "Invoice",
+		"urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0",
+	}
+	MatchBISBillingCreditNote DocumentMatcher = documentTypeMatcher{
+		"urn:oasis:names:specification:ubl:schema:xsd:CreditNote-2", "CreditNote",
+		"urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0",
+	}
+	MatchBISBillingCIIInvoice    DocumentMatcher = matcherFor(BISBillingCIIInvoiceID)
+	MatchBISOrder                DocumentMatcher = matcherFor(BISOrderID)
+	MatchBISOrderResponse        DocumentMatcher = matcherFor(BISOrderResponseID)
+	MatchBISDespatchAdvice       DocumentMatcher = matcherFor(BISDespatchAdviceID)
+	MatchBISCatalogue            DocumentMatcher = matcherFor(BISCatalogueID)
+	MatchBISMessageLevelResponse DocumentMatcher = matcherFor(BISMessageLevelResponseID)
+)
+
+// customizationMatcher matches document types whose customization ID
+// contains any of markers, optionally restricted to one local name. National
+// profiles extend a PEPPOL customization, so their marker appears after it.
+type customizationMatcher struct {
+	localName string
+	markers   []string
+}
+
+func (m customizationMatcher) Matches(d DocumentType) bool {
+	if m.localName != "" && d.LocalName != m.localName {
+		return false
+	}
+	for _, marker := range m.markers {
+		if strings.Contains(d.CustomizationID, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// National profile matchers. EHF Billing 3.0 is identical to PEPPOL BIS
+// Billing 3.0, so only the older EHF 2.0 billing profiles and the EHF 3.0
+// post-award extensions (Advanced Ordering, Forward Billing, ...) have
+// their own customization IDs.
+var (
+	MatchEHFInvoice    DocumentMatcher = customizationMatcher{"Invoice", []string{"urn:www.difi.no:ehf:faktura:"}}
+	MatchEHFCreditNote DocumentMatcher = customizationMatcher{"CreditNote", []string{"urn:www.difi.no:ehf:kreditnota:"}}
+	MatchEHFPostAward  DocumentMatcher = customizationMatcher{"", []string{"urn:fdc:anskaffelser.no:2019:ehf:"}}
+	MatchXRechnung     DocumentMatcher = customizationMatcher{"", []string{"urn:xoev-de:kosit:standard:xrechnung", "urn:xeinkauf.de:kosit:xrechnung"}}
+	MatchSIUBL         DocumentMatcher = customizationMatcher{"", []string{"urn:fdc:nen.nl:nlcius:"}}
+)
+
+// NationalProfile is a country-specific profile of PEPPOL document types
+type NationalProfile struct {
+	Name    string          `json:"name"`    // e.g. "EHF Invoice 2.0"
+	Country string          `json:"country"` // ISO 3166-1 alpha-2 code, e.g. "NO"
+	Matcher DocumentMatcher `json:"-"`
+}
+
+// nationalProfiles are the profiles Lookup reports, in reporting order
+var nationalProfiles = []NationalProfile{
+	{"EHF Invoice 2.0", "NO", MatchEHFInvoice},
+	{"EHF Credit Note 2.0", "NO", MatchEHFCreditNote},
+	{"EHF Post-Award 3.0", "NO", MatchEHFPostAward},
+	{"XRechnung", "DE", MatchXRechnung},
+	{"SI-UBL", "NL", MatchSIUBL},
+}
+
+// SupportedNationalProfiles returns the national profiles, such as the
+// Norwegian EHF profiles, that any of documentTypes belongs to
+func SupportedNationalProfiles(documentTypes []string) []NationalProfile {
+	var supported []NationalProfile
+	for _, profile := range nationalProfiles {
+		for _, id := range documentTypes {
+			if profile.Matcher.Matches(ParseDocumentType(id)) {
+				supported = append(supported, profile)
+				break
+			}
+		}
+	}
+	return supported
+}
+
+// namedMatcher is a registered capability
+type namedMatcher struct {
+	name    string
+	matcher DocumentMatcher
+}
+
+// Capability names of the BIS Billing matchers
+const (
+	capabilityBISBillingInvoice    = "BIS Billing 3.0 Invoice"
+	capabilityBISBillingCreditNote = "BIS Billing 3.0 Credit Note"
+)
+
+var (
+	matchersMu sync.RWMutex
+	matchers   = []namedMatcher{
+		{capabilityBISBillingInvoice, MatchBISBillingInvoice},
+		{capabilityBISBillingCreditNote, MatchBISBillingCreditNote},
+		{"BIS Billing 3.0 CII Invoice", MatchBISBillingCIIInvoice},
+		{"BIS Ordering 3.0 Order", MatchBISOrder},
+		{"BIS Ordering 3.0 Order Response", MatchBISOrderResponse},
+		{"BIS Despatch Advice 3.0", MatchBISDespatchAdvice},
+		{"BIS Catalogue 3.0", MatchBISCatalogue},
+		{"BIS Message Level Response 3.0", MatchBISMessageLevelResponse},
+	}
+)
+
+// RegisterMatcher adds a capability that Lookup reports under name.
+// Registering an existing name replaces its matcher.
+func RegisterMatcher(name string, matcher DocumentMatcher) {
+	matchersMu.Lock()
+	defer matchersMu.Unlock()
+	for i := range matchers {
+		if matchers[i].name == name {
+			matchers[i].matcher = matcher
+			return
+		}
+	}
+	matchers = append(matchers, namedMatcher{name, matcher})
+}
+
+// matchCapabilities returns the names of the registered capabilities that
+// any of documentTypes provides, in registration order
+func matchCapabilities(documentTypes []string) []string {
+	parsed := make([]DocumentType, len(documentTypes))
+	for i, id := range documentTypes {
+		parsed[i] = ParseDocumentType(id)
+	}
+
+	matchersMu.RLock()
+	defer matchersMu.RUnlock()
+	var capabilities []string
+	for _, m := range matchers {
+		for _, docType := range parsed {
+			if m.matcher.Matches(docType) {
+				capabilities = append(capabilities, m.name)
+				break
+			}
+		}
+	}
+	return capabilities
+}
+
+// SupportQuery is the question SupportsDocumentTypes answers, which
+// decides when it can stop early
+type SupportQuery int
+
+const (
+	SupportsEach SupportQuery = iota // check every document type
+	SupportsAny                      // is any supported? Stops at the first that is.
+	SupportsAll                      // are all supported? Stops at the first that isn't.
+)
+
+// DocumentSupport is the outcome for one document type of
+// SupportsDocumentTypes
+type DocumentSupport struct {
+	DocumentType string
+	Checked      bool      // false if the check was stopped early because the answer was already known
+	Supported    bool      // the participant receives DocumentType
+	Endpoint     *Endpoint // preferred endpoint if Supported (see TransportPreference)
+	Err          error     // why the check failed, if it did
+}
+
+// SupportsDocumentTypes checks concurrently, up to MaxConcurrentFetches at
+// a time, which of docTypes a participant receives, and returns the answer
+// to query along with a DocumentSupport per document type, in order
+//
+// Document types are matched as in DocumentMetadata; the ServiceGroup is
+// fetched at most once. Once the answer to query is known, the remaining
+// checks are cancelled and left unchecked. Failed checks are only returned
+// as an error if the answer depends on them; a cancelled ctx is always
+// returned.
+func (c *Client) SupportsDocumentTypes(ctx context.Context, icd, identifier string, docTypes []string, query SupportQuery) (bool, []DocumentSupport, error) {
+	smpHostname, err := c.smlLookup(ctx, icd, identifier)
+	if err != nil {
+		return false, nil, err
+	}
+	baseURL := SMPHostURL(smpHostname)
+
+	// Identifiers without a customization are looked for in the ServiceGroup
+	var hrefs []string
+	for _, docType := range docTypes {
+		if !strings.Contains(docType, "##") {
+			hrefs, _, err = c.fetchServiceGroup(ctx, baseURL, icd, identifier)
+			if err != nil && !errors.Is(err, ErrNoDocuments) {
+				return false, nil, err
+			}
+			break
+		}
+	}
+
+	checkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]DocumentSupport, len(docTypes))
+	parallel.ForEach(len(docTypes), c.MaxConcurrentFetches, func(i int) {
+		results[i].DocumentType = docTypes[i]
+		if checkCtx.Err() != nil {
+			return
+		}
+		var metadata *ServiceMetadata
+		var err error
+		if strings.Contains(docTypes[i], "##") {
+			metadata, err = c.directDocumentMetadata(checkCtx, baseURL, icd, identifier, docTypes[i])
+		} else {
+			metadata, err = c.listedDocumentMetadata(checkCtx, hrefs, docTypes[i])
+		}
+		if err != nil && checkCtx.Err() != nil {
+			// Cancelled because the answer is known, or with ctx
+			return
+		}
+
+		results[i].Checked, results[i].Err = true, err
+		if metadata != nil {
+			results[i].Supported = true
+			results[i].Endpoint = metadata.PreferredEndpoint(c.transportPreference())
+		}
+		if err == nil && (query == SupportsAny && results[i].Supported || query == SupportsAll && !results[i].Supported) {
+			cancel()
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return false, results, err
+	}
+
+	var failures []error
+	anySupported, anyUnsupported := false, false
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failures = append(failures, fmt.Errorf("%s: %v", result.DocumentType, result.Err))
+		case result.Supported:
+			anySupported = true
+		case result.Checked:
+			anyUnsupported = true
+		}
+	}
+	switch {
+	case query == SupportsAny && anySupported:
+		return true, results, nil
+	case query != SupportsAny && anyUnsupported:
+		return false, results, nil
+	case len(failures) > 0:
+		return false, results, errors.Join(failures...)
+	}
+	return query != SupportsAny, results, nil
+}
+
+// SupportsDocumentType reports whether a participant receives docType and,
+// if so, their preferred endpoint for it (see TransportPreference)
+func (c *Client) SupportsDocumentType(ctx context.Context, icd, identifier, docType string) (bool, *Endpoint, error) {
+	metadata, err := c.DocumentMetadata(ctx, icd, identifier, docType)
+	if err != nil || metadata == nil {
+		return false, nil, err
+	}
+	return true, metadata.PreferredEndpoint(c.transportPreference()), nil
+}
+
+// transportPreference returns the transport profile preference in use
+func (c *Client) transportPreference() []TransportProfile {
+	if len(c.TransportPreference) == 0 {
+		return DefaultTransportPreference
+	}
+	return c.TransportPreference
+}
+
+// BillingEndpoints holds where a participant receives PEPPOL BIS Billing 3.0
+// documents. A nil endpoint means the document type is not supported.
+type BillingEndpoints struct {
+	Invoice    *Endpoint
+	CreditNote *Endpoint
+}
+
+// GetBillingEndpoints looks up the Invoice and CreditNote endpoints of a
+// participant, fetching both ServiceMetadata documents concurrently with
+// SupportsDocumentTypes, so the participant is resolved only once
+func (c *Client) GetBillingEndpoints(ctx context.Context, icd, identifier string) (*BillingEndpoints, error) {
+	_, support, err := c.SupportsDocumentTypes(ctx, icd, identifier,
+		[]string{BISBillingInvoiceID, BISBillingCreditNoteID}, SupportsEach)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range support {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+	}
+	return &BillingEndpoints{Invoice: support[0].Endpoint, CreditNote: support[1].Endpoint}, nil
+}
+
+// FullCapabilities resolves a participant and fetches the ServiceMetadata for
+// every document type listed in their ServiceGroup. opts override the
+// client's settings for this call only.
+func (c *Client) FullCapabilities(ctx context.Context, icd, identifier string, opts ...LookupOption) (*FullCapabilities, error) {
+	c, ctx, cancel := c.withOptions(ctx, opts)
+	defer cancel()
+
+	smpHostname, err := c.smlLookup(ctx, icd, identifier)
+	if err != nil {
+		c.audit(icd, identifier, "", nil, false, err)
+		return nil, err
+	}
+	capabilities, err := c.capabilitiesAt(ctx, SMPHostURL(smpHostname), smpHostname, icd, identifier)
+	if err != nil {
+		c.audit(icd, identifier, smpHostname, nil, false, err)
+		return nil, err
+	}
+	c.audit(icd, identifier, smpHostname, capabilities.DocumentTypes(), false, nil)
+	return capabilities, nil
+}
+
+// DocumentTypes lists the document types a participant publishes, using
+// only the SML and their ServiceGroup: one SMP request, where
+// FullCapabilities fetches every ServiceMetadata document as well and
+// Lookup may also query the Directory. Use it when the endpoints don't
+// matter. SMP 2.0 ServiceGroups name the document types directly; SMP 1.0
+// ones are read from the ServiceMetadata reference URLs.
+//
+// With ActiveOnly it also fetches every ServiceMetadata document, to leave
+// out document types without an active endpoint, so it then makes as many
+// SMP requests as FullCapabilities.
+func (c *Client) DocumentTypes(ctx context.Context, id ParticipantID) ([]DocumentType, error) {
+	ids, err := c.fullDocumentTypes(ctx, id.ICD, id.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	documentTypes := make([]DocumentType, len(ids))
+	for i, docType := range ids {
+		documentTypes[i] = ParseDocumentType(docType)
+	}
+	return documentTypes, nil
+}
+
+// UBLRootNamespace returns the root namespace of the PEPPOL document
+// identifiers for documents with the given root element, e.g.
+// "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2" for "Invoice"
+func UBLRootNamespace(rootElement string) (string, error) {
+	if rootElement == "" || strings.IndexFunc(rootElement, func(r rune) bool {
+		return !('A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	}) >= 0 {
+		return "", fmt.Errorf("invalid root element %q: expected a local name such as Invoice", rootElement)
+	}
+	// The one non-UBL syntax in PEPPOL BIS Billing
+	if rootElement == "CrossIndustryInvoice" {
+		return "urn:un:unece:uncefact:data:standard:CrossIndustryInvoice:100", nil
+	}
+	return "urn:oasis:names:specification:ubl:schema:xsd:" + rootElement + "-2", nil
+}
+
+// CanReceive reports whether a participant receives documents with the
+// given UBL root element, e.g. "Invoice" or "CreditNote", and returns the
+// full document identifier that matched. When several customizations of
+// the document match, a PEPPOL BIS one is preferred, then the first one
+// the SMP lists.
+//
+// A participant who isn't registered, or publishes no document types,
+// can't receive anything and isn't an error.
+func (c *Client) CanReceive(ctx context.Context, id ParticipantID, ublRootElement string) (bool, string, error) {
+	rootNamespace, err := UBLRootNamespace(ublRootElement)
+	if err != nil {
+		return false, "", err
+	}
+	documentTypes, err := c.fullDocumentTypes(ctx, id.ICD, id.Identifier)
+	if errors.Is(err, ErrNotRegistered) || errors.Is(err, ErrNoDocuments) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	matched := ""
+	for _, docType := range documentTypes {
+		parsed := ParseDocumentType(docType)
+		if parsed.RootNamespace != rootNamespace || parsed.LocalName != ublRootElement {
+			continue
+		}
+		if strings.Contains(parsed.CustomizationID, "urn:fdc:peppol.eu:") {
+			return true, docType, nil
+		}
+		if matched == "" {
+			matched = docType
+		}
+	}
+	return matched != "", matched, nil
+}
+
+// CanReceive calls DefaultClient.CanReceive
+func CanReceive(ctx context.Context, id ParticipantID, ublRootElement string) (bool, string, error) {
+	return DefaultClient.CanReceive(ctx, id, ublRootElement)
+}
@@ -0,0 +1,693 @@
+package peppollookup
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Client performs SML and SMP lookups
+//
+// A Client is safe for concurrent use. Create one with NewClient and adjust
+// its fields before the first lookup.
+type Client struct {
+	// SMLDomain is the DNS zone used for SML lookups
+	SMLDomain string
+
+	// ParticipantScheme is the participant identifier scheme used in SML
+	// hostnames and SMP URLs (empty means "iso6523-actorid-upis")
+	ParticipantScheme string
+
+	// HostnamePrefix precedes the MD5 hash in SML hostnames, for custom
+	// SMLs with other naming (empty means "b-")
+	HostnamePrefix string
+
+	// HTTPClient is used for all SMP requests
+	HTTPClient *http.Client
+
+	// MinTLSVersion is the oldest TLS version accepted from HTTPS SMPs and
+	// the Directory, e.g. tls.VersionTLS13. It applies when HTTPClient has
+	// no Transport of its own and must be set before the first request.
+	MinTLSVersion uint16
+
+	// RootCAs, if set, replaces the system roots when verifying HTTPS SMPs
+	// and the Directory, for private networks with their own CA. Like
+	// MinTLSVersion, it applies when HTTPClient has no Transport of its own
+	// and must be set before the first request.
+	RootCAs *x509.CertPool
+
+	// InsecureSkipVerify turns off TLS certificate verification for SMPs
+	// and the Directory, for debugging misconfigured test SMPs only: any
+	// man in the middle can then forge SMP answers. It applies like RootCAs.
+	InsecureSkipVerify bool
+
+	// ForceHTTP1 disables HTTP/2 for providers that misbehave on it. By
+	// default HTTP/2 is negotiated with HTTPS SMPs, so concurrent requests
+	// to one host share a connection. Like MinTLSVersion, it applies when
+	// HTTPClient has no Transport of its own.
+	ForceHTTP1 bool
+
+	// RateLimit caps the number of SMP requests per second (0 means unlimited)
+	RateLimit float64
+
+	// MaxConcurrentFetches bounds how many ServiceMetadata documents are
+	// fetched in parallel when building full capabilities
+	MaxConcurrentFetches int
+
+	// MaxResponseSize caps the decoded size of an SMP or Directory response
+	// in bytes, guarding against compression bombs (0 means unlimited)
+	MaxResponseSize int64
+
+	// MaxDocumentTypes caps how many ServiceMetadata documents are fetched
+	// when building full capabilities, so an SMP listing thousands of
+	// document types can't trigger thousands of requests. Past the cap the
+	// result is partial and has a warning (0 means unlimited).
+	MaxDocumentTypes int
+
+	// TransportPreference orders transport profile identifiers from most to
+	// least preferred when picking a participant's endpoint, e.g. in
+	// SupportsDocumentType. Empty means DefaultTransportPreference. See
+	// CheckTransportPreference to catch typos.
+	TransportPreference []TransportProfile
+
+	// CertExpiryWindow is how far ahead an endpoint certificate's expiry is
+	// flagged with Endpoint.CertExpiringSoon and a warning
+	CertExpiryWindow time.Duration
+
+	// ActiveOnly drops endpoints outside their activation/expiration window,
+	// and document types left without endpoints, from full capabilities,
+	// Lookup results and the Supports* checks. Lookup then fetches every
+	// ServiceMetadata document to see which are live.
+	ActiveOnly bool
+
+	// Cache stores resolved SMP hostnames and, if ResultHardTTL is set,
+	// Lookup results (nil disables caching)
+	Cache Cache
+
+	// CacheTTL is how long resolved SMP hostnames are cached
+	CacheTTL time.Duration
+
+	// NegativeCacheTTL is how long it is cached that a participant's SML
+	// hostname doesn't exist (NXDOMAIN), so repeated audits don't query it
+	// again. Keep it shorter than CacheTTL, as participants can register at
+	// any time; 0 disables negative caching. Other DNS failures are never
+	// cached.
+	NegativeCacheTTL time.Duration
+
+	// DNSRetries is how many times a temporary DNS failure (e.g. SERVFAIL)
+	// is retried. NXDOMAIN is never retried.
+	DNSRetries int
+
+	// DNSRetryBackoff is the delay before the first retry; it doubles on
+	// each subsequent retry
+	DNSRetryBackoff time.Duration
+
+	// MaxConcurrentDNS bounds how many DNS queries run at once, so large
+	// batches don't exhaust file descriptors or the cgo resolver
+	MaxConcurrentDNS int
+
+	// DNSServer ("host:port") answers the DNS queries net.Resolver can't
+	// make: NAPTR records, CNAME chains, DNS answers for DebugDNS and
+	// RequireDNSSEC lookups. Empty means the nameservers in
+	// /etc/resolv.conf, so it must be set on Windows.
+	DNSServer string
+
+	// RequireDNSSEC makes SML lookups fail with ErrDNSSECNotValidated
+	// unless DNSServer vouches for the answer with the AD (authenticated
+	// data) bit. The answers are queried from DNSServer instead of through
+	// the system resolver. Signatures are not validated here: this only
+	// reports the upstream resolver's AD flag, so DNSServer must be a
+	// validating resolver reached over a trusted path, such as one on
+	// localhost.
+	RequireDNSSEC bool
+
+	// SOCKS5Proxy ("host:port" or "socks5://[user:pass@]host:port") tunnels
+	// SMP, Directory and access point connections through a SOCKS5 proxy,
+	// such as "ssh -D". Hostnames are resolved by the proxy, and DNS queries
+	// are sent over TCP through it to DNSServer or the system nameserver,
+	// which must be reachable from the proxy's side.
+	SOCKS5Proxy string
+
+	// HealthCheckParticipant is a participant ID ("icd:identifier") known to
+	// be registered in the SML, used by CheckSMLHealth
+	HealthCheckParticipant string
+
+	// DirectoryURL is the PEPPOL Directory searched by ResolveByName and
+	// DirectoryLookupByID, and used by EnrichResults
+	DirectoryURL string
+
+	// EnrichResults adds the participant's name and country to Lookup
+	// results, from their business card in the Directory at DirectoryURL or
+	// on their SMP. Off by default, so lookups don't depend on the
+	// Directory being up.
+	EnrichResults bool
+
+	// MaxNameMatches is how many Directory matches ResolveByName looks up
+	MaxNameMatches int
+
+	// AllowedSMPDomains, if set, restricts lookups to participants whose
+	// canonical SMP host is one of these domains or a subdomain of them
+	AllowedSMPDomains []string
+
+	// DeniedSMPDomains rejects participants whose canonical SMP host is one
+	// of these domains or a subdomain of them. It takes precedence over
+	// AllowedSMPDomains.
+	DeniedSMPDomains []string
+
+	// SMLOnly makes Lookup stop after the SML registration check, leaving
+	// the SMP and Directory unqueried. Results then have no document types.
+	SMLOnly bool
+
+	// CheckSMLConsistency makes Lookup compare a participant's CNAME and
+	// NAPTR records and warn when they point to different SMPs. It costs
+	// an extra DNS query per lookup, so it's off by default.
+	CheckSMLConsistency bool
+
+	// CheckProductionSML makes Lookup, when SMLDomain is the test SML and a
+	// participant isn't registered there, check the production SML and set
+	// the NotFoundError's Warning if the participant is registered there
+	CheckProductionSML bool
+
+	// CaseFallback makes the SML lookup, when a participant isn't registered
+	// under their normalized (lowercase) ID, also try the ID as given, for
+	// SMLs where participants were registered with inconsistent casing.
+	// Results say which form resolved in SMLHashForm. Off by default, as
+	// the SML hashes the lowercase form (see SMLHashInput).
+	CaseFallback bool
+
+	// ResultSoftTTL is how long a cached Lookup result is served as fresh.
+	// Past it, the cached result is still returned but refreshed in the
+	// background (stale-while-revalidate).
+	ResultSoftTTL time.Duration
+
+	// ResultHardTTL is how long a Lookup result is kept in Cache at all;
+	// past it, Lookup blocks on a fresh lookup (0 disables result caching)
+	ResultHardTTL time.Duration
+
+	// Strict makes FullCapabilities fail when any ServiceMetadata document
+	// is malformed. By default such documents are skipped and reported in
+	// FullCapabilities.Errors so the rest of the capabilities are returned.
+	Strict bool
+
+	// CheckStructure checks the structure of XML ServiceGroup and
+	// ServiceMetadata documents with CheckSMPStructure before parsing
+	// them. A document failing the check counts as malformed (see Strict).
+	CheckStructure bool
+
+	// EmptyRetries is how many times a ServiceGroup that is missing or
+	// lists no document types is fetched again, to ride out SMP
+	// publication lag right after a participant registers (0 disables)
+	EmptyRetries int
+
+	// EmptyRetryDelay is the wait between EmptyRetries attempts
+	EmptyRetryDelay time.Duration
+
+	// UserAgent is sent with every HTTP request (empty sends Go's default)
+	UserAgent string
+
+	// PreferJSON asks SMPs for their JSON representation of ServiceGroup
+	// and ServiceMetadata documents. Responses are parsed by their
+	// Content-Type either way, so SMPs that only serve XML keep working.
+	PreferJSON bool
+
+	// DebugDNS makes Lookup record the full DNS answers for the
+	// participant's SML names in Result.Debug
+	DebugDNS bool
+
+	// MaxCNAMEDepth is how many CNAME hops Lookup follows from a
+	// participant's SML hostname before giving up. Tracing costs a DNS
+	// query per hop, so it's off (0) by default; --debug sets it to
+	// DefaultMaxCNAMEDepth.
+	MaxCNAMEDepth int
+
+	// MaxRedirects is how many HTTP redirects an SMP or Directory request
+	// follows before failing with ErrTooManyRedirects (0 follows none).
+	// Redirects back to a URL already visited fail with ErrRedirectLoop.
+	MaxRedirects int
+
+	// Tracer traces lookups with OpenTelemetry spans: "peppol.Lookup"
+	// around Lookup, with "sml.resolve" and "smp.fetch" children for the
+	// SML query and each SMP request. nil uses the global tracer provider,
+	// which is a no-op until one is configured.
+	Tracer trace.Tracer
+
+	// AuditLog, if set, receives an AuditRecord for every Lookup and
+	// FullCapabilities call as one line of JSON, cached results and
+	// failures included
+	AuditLog io.Writer
+
+	// BreakerThreshold is how many consecutive failed requests (network
+	// errors or 5xx responses) to one host open its circuit, so further
+	// requests to it fail fast with ErrCircuitOpen (0 disables)
+	BreakerThreshold int
+
+	// BreakerCooldown is how long an open circuit rejects requests. After
+	// it, requests go through again and a single failure reopens it.
+	BreakerCooldown time.Duration
+
+	state *clientState
+}
+
+// clientState is the runtime state a Client shares with its per-call
+// copies (see LookupOption), so they draw on one rate limit, circuit
+// breaker table, DNS query budget and connection pool
+type clientState struct {
+	mu       sync.Mutex
+	nextSlot time.Time
+	breakers map[string]*breaker // per-host circuit state, guarded by mu
+
+	dnsSlotsOnce sync.Once
+	dnsSlots     chan struct{}
+
+	refreshing map[string]bool // participants with a background refresh in flight
+
+	transportOnce sync.Once
+	transport     *http.Transport
+
+	auditMu sync.Mutex // serializes writes to AuditLog
+}
+
+// modulePath is the path of the module this package belongs to
+const modulePath = "github.com/snapbooks-app/peppol-lookup/go"
+
+// defaultUserAgent identifies this module's version to SMP and Directory
+// operators
+func defaultUserAgent() string {
+	v := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, module := range append([]*debug.Module{&info.Main}, info.Deps...) {
+			if module.Path == modulePath && module.Version != "" && module.Version != "(devel)" {
+				v = module.Version
+			}
+		}
+	}
+	return "peppol-lookup/" + v
+}
+
+// NewClient returns a Client with sensible defaults
+func NewClient() *Client {
+	return &Client{
+		SMLDomain:         smlDomain,
+		ParticipantScheme: participantScheme,
+		HostnamePrefix:    smlHostnamePrefix,
+		HTTPClient: &http.Client{
+			Timeout:       30 * time.Second,
+			CheckRedirect: recordRedirect,
+		},
+		MinTLSVersion:          tls.VersionTLS12,
+		MaxConcurrentFetches:   8,
+		MaxResponseSize:        10 << 20,
+		MaxDocumentTypes:       500,
+		CertExpiryWindow:       30 * 24 * time.Hour,
+		Cache:                  NewMemoryCache(),
+		CacheTTL:               time.Hour,
+		NegativeCacheTTL:       5 * time.Minute,
+		DNSRetries:             2,
+		DNSRetryBackoff:        200 * time.Millisecond,
+		MaxConcurrentDNS:       64,
+		HealthCheckParticipant: "0192:921605900",
+		DirectoryURL:           "https://directory.peppol.eu",
+		MaxNameMatches:         5,
+		CheckProductionSML:     true,
+		MaxRedirects:           10,
+		EmptyRetryDelay:        5 * time.Second,
+		UserAgent:              defaultUserAgent(),
+		BreakerThreshold:       5,
+		BreakerCooldown:        30 * time.Second,
+		state:                  &clientState{},
+	}
+}
+
+// LookupOption overrides a Client setting for a single Lookup or
+// FullCapabilities call, so one client can serve calls with different
+// settings, e.g. both test and production lookups. The client's settings
+// are the base and aren't changed. The call still shares the client's rate
+// limit, circuit breakers, DNS query limit, connections and cache.
+type LookupOption func(*lookupCall)
+
+// lookupCall is the per-call configuration LookupOptions build
+type lookupCall struct {
+	client  *Client // copy of the client with the call's settings
+	timeout time.Duration
+}
+
+// WithEnvironment queries env's SML, participant scheme and Directory.
+// The environment's root CAs aren't applied, since connections are shared;
+// use a separate Client for an environment with its own CA.
+func WithEnvironment(env Environment) LookupOption {
+	return func(call *lookupCall) {
+		call.client.SMLDomain = env.SMLDomain
+		call.client.ParticipantScheme = env.Scheme
+		call.client.HostnamePrefix = env.HostnamePrefix
+		call.client.DirectoryURL = env.DirectoryURL
+	}
+}
+
+// WithTimeout bounds the whole call, SML and SMP queries included
+func WithTimeout(timeout time.Duration) LookupOption {
+	return func(call *lookupCall) { call.timeout = timeout }
+}
+
+// WithSMLOnly sets Client.SMLOnly for the call
+func WithSMLOnly(smlOnly bool) LookupOption {
+	return func(call *lookupCall) { call.client.SMLOnly = smlOnly }
+}
+
+// withOptions returns the client and context a call with opts runs with,
+// and a function releasing the context's resources
+func (c *Client) withOptions(ctx context.Context, opts []LookupOption) (*Client, context.Context, context.CancelFunc) {
+	if len(opts) == 0 {
+		return c, ctx, func() {}
+	}
+	clone := *c
+	call := lookupCall{client: &clone}
+	for _, opt := range opts {
+		opt(&call)
+	}
+	if call.timeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, call.timeout)
+		return call.client, ctx, cancel
+	}
+	return call.client, ctx, func() {}
+}
+
+// Cache is a string-keyed store with per-entry expiry
+//
+// Implement it to share lookups between processes, e.g. backed by Redis.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored under key, if present and not expired
+	Get(key string) (string, bool)
+
+	// Set stores value under key for ttl
+	Set(key, value string, ttl time.Duration)
+
+	// Delete removes key, if present
+	Delete(key string)
+}
+
+// tracerName is the instrumentation scope of the spans of the global
+// tracer provider
+const tracerName = "github.com/snapbooks-app/peppol-lookup/go/peppollookup"
+
+// startSpan starts a span with c.Tracer, or with the global tracer
+// provider if it's nil
+func (c *Client) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	tracer := c.Tracer
+	if tracer == nil {
+		tracer = otel.Tracer(tracerName)
+	}
+	return tracer.Start(ctx, name)
+}
+
+// endSpan ends span, marking it failed if err is non-nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// DebugInfo describes how an SMP request was answered
+type DebugInfo struct {
+	RequestURL string   `json:"request_url"`
+	Redirects  []string `json:"redirects,omitempty"` // each URL redirected to, in order
+	FinalURL   string   `json:"final_url"`
+	StatusCode int      `json:"status_code"`
+	CNAMEChain []string `json:"cname_chain,omitempty"` // SML hostname followed by each CNAME target
+	IDEncoding string   `json:"id_encoding,omitempty"` // how the SMP accepted the participant ID, e.g. "percent-encoded"
+
+	// ParticipantID is the identifier the ServiceGroup says it belongs to,
+	// e.g. "iso6523-actorid-upis::0192:921605900"
+	ParticipantID string `json:"participant_id,omitempty"`
+
+	// DNSAnswers holds every record returned for the participant's SML
+	// names, if Client.DebugDNS is set
+	DNSAnswers []DNSRecord `json:"dns_answers,omitempty"`
+
+	// TLSCertificates is the certificate chain the SMP presented, leaf
+	// first, or empty if it was fetched over plain HTTP
+	TLSCertificates []*CertificateInfo `json:"tls_certificates,omitempty"`
+}
+
+// DNSRecord is one resource record from a DNS answer
+type DNSRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"` // "A", "AAAA", "CNAME" or "NAPTR"
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"` // address, CNAME target or NAPTR record data
+}
+
+type debugInfoKey struct{}
+
+// withDebugInfo returns a context whose requests record their redirect
+// chain and final response in debug
+func withDebugInfo(ctx context.Context, debug *DebugInfo) context.Context {
+	return context.WithValue(ctx, debugInfoKey{}, debug)
+}
+
+// Redirect failures, matched by a *RedirectError
+var (
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrRedirectLoop     = errors.New("redirect loop")
+)
+
+// RedirectError is returned when a request is redirected more than
+// Client.MaxRedirects times or back to a URL it already visited
+type RedirectError struct {
+	Chain []string // the requested URL followed by each URL redirected to
+	Loop  bool
+}
+
+func (e *RedirectError) Error() string {
+	if e.Loop {
+		return fmt.Sprintf("redirect loop: %s", strings.Join(e.Chain, " -> "))
+	}
+	return fmt.Sprintf("more than %d redirects: %s", len(e.Chain)-2, strings.Join(e.Chain, " -> "))
+}
+
+// Is matches ErrRedirectLoop or ErrTooManyRedirects
+func (e *RedirectError) Is(target error) bool {
+	return target == ErrRedirectLoop && e.Loop || target == ErrTooManyRedirects && !e.Loop
+}
+
+type maxRedirectsKey struct{}
+
+// recordRedirect is the HTTP client's CheckRedirect. It enforces the
+// Client.MaxRedirects of the request's context (10 if unset), stops
+// redirect loops and adds each hop to the request's DebugInfo.
+func recordRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects, ok := req.Context().Value(maxRedirectsKey{}).(int)
+	if !ok {
+		maxRedirects = 10
+	}
+	chain := make([]string, 0, len(via)+1)
+	for _, r := range via {
+		chain = append(chain, r.URL.String())
+	}
+	next := req.URL.String()
+	loop := slices.Contains(chain, next)
+	if loop || len(via) > maxRedirects {
+		return &RedirectError{Chain: append(chain, next), Loop: loop}
+	}
+	if debug, ok := req.Context().Value(debugInfoKey{}).(*DebugInfo); ok {
+		debug.Redirects = append(debug.Redirects, next)
+	}
+	return nil
+}
+
+// DefaultClient is used by the package-level lookup functions
+var DefaultClient = NewClient()
+
+// Environment is a named PEPPOL-like network: where its SML lives, which
+// participant identifier scheme it uses and which CAs its SMPs chain to
+type Environment struct {
+	Name           string   `json:"name"`
+	SMLDomain      string   `json:"sml_domain"`
+	Scheme         string   `json:"scheme,omitempty"`          // defaults to "iso6523-actorid-upis"
+	HostnamePrefix string   `json:"hostname_prefix,omitempty"` // defaults to "b-"
+	RootCAs        []string `json:"root_cas,omitempty"`        // PEM files trusted for SMP TLS instead of the system roots
+	DirectoryURL   string   `json:"directory_url,omitempty"`   // empty disables Directory searches and enrichment
+}
+
+// DefaultEnvironments are the PEPPOL production and test networks
+var DefaultEnvironments = map[string]Environment{
+	"production": {
+		Name:         "production",
+		SMLDomain:    smlDomain,
+		Scheme:       participantScheme,
+		DirectoryURL: "https://directory.peppol.eu",
+	},
+	"test": {
+		Name:         "test",
+		SMLDomain:    testSMLDomain,
+		Scheme:       participantScheme,
+		DirectoryURL: "https://test-directory.peppol.eu",
+	},
+}
+
+// environmentsFile is the JSON layout of an environments config file
+type environmentsFile struct {
+	Environments []Environment `json:"environments"`
+}
+
+// LoadEnvironments reads named environments from a JSON file of the form
+//
+//	{"environments": [{"name": "...", "sml_domain": "...", "scheme": "...", "hostname_prefix": "...", "root_cas": ["..."]}]}
+//
+// and returns them together with DefaultEnvironments, which entries of the
+// same name override. Relative root_cas paths are resolved against the
+// file's directory.
+func LoadEnvironments(path string) (map[string]Environment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file environmentsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	environments := make(map[string]Environment, len(DefaultEnvironments)+len(file.Environments))
+	for name, env := range DefaultEnvironments {
+		environments[name] = env
+	}
+	for i, env := range file.Environments {
+		if env.Name == "" || env.SMLDomain == "" {
+			return nil, fmt.Errorf("%s: environment %d needs a name and sml_domain", path, i+1)
+		}
+		for j, ca := range env.RootCAs {
+			if !filepath.IsAbs(ca) {
+				env.RootCAs[j] = filepath.Join(filepath.Dir(path), ca)
+			}
+		}
+		environments[env.Name] = env
+	}
+	return environments, nil
+}
+
+// Apply configures c to query env
+func (env Environment) Apply(c *Client) error {
+	c.SMLDomain = env.SMLDomain
+	c.ParticipantScheme = env.Scheme
+	c.HostnamePrefix = env.HostnamePrefix
+	c.DirectoryURL = env.DirectoryURL
+	if len(env.RootCAs) == 0 {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	for _, path := range env.RootCAs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", path)
+		}
+	}
+	c.RootCAs = pool
+	return nil
+}
+
+// wait blocks until the rate limiter allows another SMP request
+func (c *Client) wait(ctx context.Context) error {
+	if c.RateLimit <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / c.RateLimit)
+
+	c.state.mu.Lock()
+	slot := c.state.nextSlot
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	c.state.nextSlot = slot.Add(interval)
+	c.state.mu.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrCircuitOpen is returned for requests to a host whose circuit breaker
+// is open after BreakerThreshold consecutive failures
+var ErrCircuitOpen = errors.New("circuit open")
+
+// breaker tracks consecutive request failures to one host
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether a request to host may proceed
+func (c *Client) allow(host string) error {
+	if c.BreakerThreshold <= 0 {
+		return nil
+	}
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	b := c.state.breakers[host]
+	if b == nil || b.openUntil.IsZero() {
+		return nil
+	}
+	if until := time.Until(b.openUntil); until > 0 {
+		return fmt.Errorf("%w: %s failed %d times in a row, retrying in %v",
+			ErrCircuitOpen, host, b.failures, until.Round(time.Millisecond))
+	}
+	// Cooldown over: let requests through, but trip again on the next failure
+	b.openUntil = time.Time{}
+	b.failures = c.BreakerThreshold - 1
+	return nil
+}
+
+// record updates host's circuit breaker with the outcome of a request
+func (c *Client) record(host string, failed bool) {
+	if c.BreakerThreshold <= 0 {
+		return
+	}
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	if !failed {
+		delete(c.state.breakers, host)
+		return
+	}
+	if c.state.breakers == nil {
+		c.state.breakers = make(map[string]*breaker)
+	}
+	b := c.state.breakers[host]
+	if b == nil {
+		b = &breaker{}
+		c.state.breakers[host] = b
+	}
+	b.failures++
+	if b.failures >= c.BreakerThreshold && b.openUntil.IsZero() {
+		b.openUntil = time.Now().Add(c.BreakerCooldown)
+	}
+}
@@ -0,0 +1,293 @@
+package peppollookup
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/snapbooks-app/peppol-lookup/go/internal/parallel"
+)
+
+// directorySearchJSON is the part of a PEPPOL Directory search response we use
+type directorySearchJSON struct {
+	Matches []struct {
+		ParticipantID struct {
+			Scheme string `json:"scheme"`
+			Value  string `json:"value"`
+		} `json:"participantID"`
+		DocTypes []struct {
+			Scheme string `json:"scheme"`
+			Value  string `json:"value"`
+		} `json:"docTypes"`
+		Entities []struct {
+			Name []struct {
+				Name string `json:"name"`
+			} `json:"name"`
+			CountryCode string `json:"countryCode"`
+			RegDate     string `json:"regDate"`
+		} `json:"entities"`
+	} `json:"matches"`
+}
+
+// BusinessCard looks up a participant's name and country in the PEPPOL
+// Directory. Both are empty if the participant has no business card.
+func (c *Client) BusinessCard(ctx context.Context, icd, identifier string) (name, country string, err error) {
+	query := url.Values{"participant": {c.scheme() + "::" + canonicalParticipantID(icd, identifier)}}
+	body, err := c.getAccepting(ctx, strings.TrimSuffix(c.DirectoryURL, "/")+"/search/1.0/json?"+query.Encode(), "application/json")
+	if err != nil {
+		return "", "", err
+	}
+
+	var search directorySearchJSON
+	if err := json.Unmarshal(body, &search); err != nil {
+		return "", "", fmt.Errorf("failed to parse Directory response: %v", err)
+	}
+	for _, match := range search.Matches {
+		for _, entity := range match.Entities {
+			if len(entity.Name) > 0 {
+				return entity.Name[0].Name, entity.CountryCode, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// DirectoryEntity is a business entity on a participant's business card in
+// the PEPPOL Directory
+type DirectoryEntity struct {
+	Names            []string `json:"names"`
+	Country          string   `json:"country"`                     // uppercase ISO 3166-1 alpha-2 code
+	RegistrationDate string   `json:"registration_date,omitempty"` // as "YYYY-MM-DD"
+}
+
+// DirectoryComparison is what the PEPPOL Directory knows about a
+// participant next to what their SMP publishes now
+type DirectoryComparison struct {
+	ParticipantID string `json:"participant_id"`
+	Indexed       bool   `json:"indexed"` // the Directory has the participant
+
+	// Entities and DocumentTypes are as the Directory indexed them
+	Entities      []DirectoryEntity `json:"entities"`
+	DocumentTypes []string          `json:"document_types"`
+
+	// SMPDocumentTypes are the document types the participant's SMP
+	// publishes, empty if they aren't registered in the SML
+	SMPDocumentTypes []string `json:"smp_document_types"`
+
+	// NotInDirectory and NotOnSMP list the document types only the SMP or
+	// only the Directory has, which suggests stale Directory indexing
+	NotInDirectory []string `json:"not_in_directory"`
+	NotOnSMP       []string `json:"not_on_smp"`
+
+	Warnings []string `json:"warnings"`
+}
+
+// DirectoryLookupByID looks a participant up by exact ID in the PEPPOL
+// Directory and compares the business entities and document types it has
+// indexed with the document types on the participant's SMP
+//
+// Only a failed Directory query is returned as an error; the SMP side is
+// best-effort, with failures among the warnings.
+func (c *Client) DirectoryLookupByID(ctx context.Context, id ParticipantID) (*DirectoryComparison, error) {
+	if c.DirectoryURL == "" {
+		return nil, errors.New("looking up the Directory requires a DirectoryURL")
+	}
+	query := url.Values{"participant": {c.scheme() + "::" + id.canonical()}}
+	body, err := c.getAccepting(ctx, strings.TrimSuffix(c.DirectoryURL, "/")+"/search/1.0/json?"+query.Encode(), "application/json")
+	if err != nil {
+		return nil, fmt.Errorf("looking up %s in the Directory failed: %v", id, err)
+	}
+	var search directorySearchJSON
+	if err := json.Unmarshal(body, &search); err != nil {
+		return nil, fmt.Errorf("failed to parse Directory response: %v", err)
+	}
+
+	comparison := &DirectoryComparison{
+		ParticipantID:    id.String(),
+		Entities:         []DirectoryEntity{},
+		DocumentTypes:    []string{},
+		SMPDocumentTypes: []string{},
+		NotInDirectory:   []string{},
+		NotOnSMP:         []string{},
+		Warnings:         []string{},
+	}
+	for _, match := range search.Matches {
+		comparison.Indexed = true
+		for _, entity := range match.Entities {
+			names := make([]string, 0, len(entity.Name))
+			for _, name := range entity.Name {
+				names = append(names, name.Name)
+			}
+			comparison.Entities = append(comparison.Entities, DirectoryEntity{
+				Names:            names,
+				Country:          countryCode(entity.CountryCode),
+				RegistrationDate: entity.RegDate,
+			})
+		}
+		for _, docType := range match.DocTypes {
+			comparison.DocumentTypes = append(comparison.DocumentTypes, docType.Value)
+		}
+	}
+
+	smpDocumentTypes, err := c.fullDocumentTypes(ctx, id.ICD, id.Identifier)
+	switch {
+	case errors.Is(err, ErrNotRegistered):
+		comparison.Warnings = append(comparison.Warnings, "participant is not registered in the SML")
+	case errors.Is(err, ErrNoDocuments):
+	case err != nil:
+		comparison.Warnings = append(comparison.Warnings, fmt.Sprintf("SMP document types unavailable: %v", err))
+		return comparison, nil
+	}
+	comparison.SMPDocumentTypes = append(comparison.SMPDocumentTypes, smpDocumentTypes...)
+
+	inDirectory := make(map[string]bool)
+	for _, docType := range comparison.DocumentTypes {
+		inDirectory[docType] = true
+	}
+	onSMP := make(map[string]bool)
+	for _, docType := range comparison.SMPDocumentTypes {
+		onSMP[docType] = true
+		if !inDirectory[docType] {
+			comparison.NotInDirectory = append(comparison.NotInDirectory, docType)
+		}
+	}
+	for _, docType := range comparison.DocumentTypes {
+		if !onSMP[docType] {
+			comparison.NotOnSMP = append(comparison.NotOnSMP, docType)
+		}
+	}
+	return comparison, nil
+}
+
+// DirectoryLookupByID calls DefaultClient.DirectoryLookupByID
+func DirectoryLookupByID(ctx context.Context, id ParticipantID) (*DirectoryComparison, error) {
+	return DefaultClient.DirectoryLookupByID(ctx, id)
+}
+
+// searchDirectory searches the PEPPOL Directory for participants whose
+// business card matches name and returns them in the Directory's order
+func (c *Client) searchDirectory(ctx context.Context, name string) ([]ParticipantID, error) {
+	query := url.Values{"q": {name}}
+	body, err := c.getAccepting(ctx, strings.TrimSuffix(c.DirectoryURL, "/")+"/search/1.0/json?"+query.Encode(), "application/json")
+	if err != nil {
+		return nil, err
+	}
+
+	var search directorySearchJSON
+	if err := json.Unmarshal(body, &search); err != nil {
+		return nil, fmt.Errorf("failed to parse Directory response: %v", err)
+	}
+	var ids []ParticipantID
+	for _, match := range search.Matches {
+		if match.ParticipantID.Scheme != c.scheme() {
+			continue
+		}
+		if id, err := ParseParticipantID(match.ParticipantID.Value); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ResolveByName searches the PEPPOL Directory for a company name and
+// reports on the best MaxNameMatches matches, in the Directory's order
+//
+// A match whose lookup fails is still reported, with the failure among its
+// warnings. Only a failed search is returned as an error.
+func (c *Client) ResolveByName(ctx context.Context, name string) ([]CapabilityReport, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("empty company name")
+	}
+	if c.DirectoryURL == "" {
+		return nil, errors.New("searching by name requires a DirectoryURL")
+	}
+	ids, err := c.searchDirectory(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("searching the Directory for %q failed: %v", name, err)
+	}
+	if c.MaxNameMatches > 0 && len(ids) > c.MaxNameMatches {
+		ids = ids[:c.MaxNameMatches]
+	}
+
+	reports := make([]CapabilityReport, len(ids))
+	parallel.ForEach(len(ids), len(ids), func(i int) {
+		report, err := c.Report(ctx, ids[i])
+		if err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("lookup failed: %v", err))
+		}
+		reports[i] = report
+	})
+	return reports, nil
+}
+
+// smpBusinessCardXML is the part of a PEPPOL business card we use. SMPs
+// that feed the Directory publish it at /businesscard/{participant}.
+type smpBusinessCardXML struct {
+	Entities []struct {
+		Name        []string `xml:"Name"`
+		CountryCode string   `xml:"CountryCode"`
+	} `xml:"BusinessEntity"`
+}
+
+// smpBusinessCard fetches a participant's business card from their SMP.
+// Both results are empty if the SMP publishes none; SMPs without business
+// card support answer with a 4xx status, which is treated the same way.
+func (c *Client) smpBusinessCard(ctx context.Context, baseURL, icd, identifier string) (name, country string, err error) {
+	body, err := c.get(ctx, baseURL+"/businesscard/"+escapePathSegment(c.scheme()+"::"+canonicalParticipantID(icd, identifier)))
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode < 500 {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var card smpBusinessCardXML
+	if err := xml.Unmarshal(body, &card); err != nil {
+		return "", "", fmt.Errorf("failed to parse business card: %v", err)
+	}
+	for _, entity := range card.Entities {
+		if len(entity.Name) > 0 {
+			return strings.TrimSpace(entity.Name[0]), entity.CountryCode, nil
+		}
+	}
+	return "", "", nil
+}
+
+// countryCode normalizes a published country to an ISO 3166-1 alpha-2
+// code, returning "" for anything else
+func countryCode(country string) string {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+		return ""
+	}
+	return country
+}
+
+// CountryCode returns the ISO 3166-1 alpha-2 country a participant
+// publishes in their business card, taken from their SMP or, failing that,
+// the PEPPOL Directory. It is "" if neither publishes one; the country is
+// never guessed from the identifier scheme.
+func (c *Client) CountryCode(ctx context.Context, p ParticipantID) (string, error) {
+	smpHostname, err := c.smlLookup(ctx, p.ICD, p.Identifier)
+	if err != nil {
+		return "", err
+	}
+	_, country, smpErr := c.smpBusinessCard(ctx, SMPHostURL(smpHostname), p.ICD, p.Identifier)
+	if code := countryCode(country); code != "" {
+		return code, nil
+	}
+	if c.DirectoryURL == "" {
+		return "", smpErr
+	}
+	_, country, err = c.BusinessCard(ctx, p.ICD, p.Identifier)
+	if err != nil && smpErr != nil {
+		return "", fmt.Errorf("no business card available: SMP: %v; Directory: %v", smpErr, err)
+	}
+	return countryCode(country), nil
+}
@@ -0,0 +1,24 @@
+/*
+Package peppollookup looks up PEPPOL participants and what they can receive.
+
+PEPPOL uses two key services to enable document exchange:
+
+1. SML (Service Metadata Locator):
+  - Acts as a DNS-based directory service
+  - Maps a participant's ID to their SMP provider
+  - Uses DNS lookup to find where a participant's metadata is hosted
+  - Similar to how email's MX records help find mail servers
+
+2. SMP (Service Metadata Publisher):
+  - Hosts metadata about a participant's capabilities
+  - Tells you what document types they can receive
+  - Provides technical details needed for sending documents
+  - Acts like a participant's business card in the network
+
+A Client uses SML to find where a participant's metadata is hosted, then
+queries their SMP to discover what documents they can receive:
+
+	client := peppollookup.NewClient()
+	result, err := client.Lookup(ctx, "0192", "923456783")
+*/
+package peppollookup
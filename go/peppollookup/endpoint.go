@@ -0,0 +1,475 @@
+package peppollookup
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is an access point that receives documents for a process
+type Endpoint struct {
+	TransportProfile TransportProfile
+	Address          string
+	URL              *url.URL  // Address parsed; always an absolute http(s) URL
+	Certificate      string    // base64-encoded DER certificate
+	ActivationDate   time.Time // zero if not published
+	ExpirationDate   time.Time // zero if not published
+
+	// Descriptive fields, empty if not published
+	ServiceDescription         string
+	TechnicalContactURL        string
+	MinimumAuthenticationLevel string
+
+	// Certificate expiry as of when the metadata was fetched, set only if
+	// Certificate parses. CertExpiresInDays counts whole days and is
+	// negative once the certificate has expired.
+	CertExpiresInDays int
+	CertExpiringSoon  bool // expires within the client's CertExpiryWindow
+	CertExpired       bool
+}
+
+// checkCertificateExpiry sets the endpoint's certificate expiry fields as
+// of now, flagging certificates that expire within window
+func (e *Endpoint) checkCertificateExpiry(now time.Time, window time.Duration) {
+	cert, err := e.ParseCertificate()
+	if err != nil {
+		return
+	}
+	remaining := cert.NotAfter.Sub(now)
+	e.CertExpiresInDays = int(remaining / (24 * time.Hour))
+	e.CertExpired = remaining <= 0
+	e.CertExpiringSoon = !e.CertExpired && remaining <= window
+}
+
+// CertificateInfo is a printable summary of an endpoint certificate
+type CertificateInfo struct {
+	PEM               string    `json:"pem"`
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	SHA256Fingerprint string    `json:"sha256_fingerprint"`
+}
+
+// ParseCertificate decodes the endpoint's base64 certificate
+func (e Endpoint) ParseCertificate() (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(e.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate encoding: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// ErrCertificateMismatch is matched by a *CertificateMismatchError
+var ErrCertificateMismatch = errors.New("endpoint certificate does not match SMP metadata")
+
+// CertificateMismatchError is returned by VerifyEndpointCertificate when the
+// certificate an access point presents over TLS is not the one its SMP
+// metadata lists, as is usual for APs with a public CA TLS certificate
+type CertificateMismatchError struct {
+	Address   string
+	Published string // SHA-256 fingerprint of the SMP-listed certificate
+	Presented string // SHA-256 fingerprint of the TLS leaf certificate
+}
+
+func (e *CertificateMismatchError) Error() string {
+	return fmt.Sprintf("%s presented certificate %s, but its SMP metadata lists %s",
+		e.Address, e.Presented, e.Published)
+}
+
+// Is makes errors.Is(err, ErrCertificateMismatch) true
+func (e *CertificateMismatchError) Is(target error) bool {
+	return target == ErrCertificateMismatch
+}
+
+// VerifyEndpointCertificate connects to the endpoint's address and checks
+// whether the certificate presented during the TLS handshake is the one
+// published in the SMP. It is opt-in as it contacts the access point itself.
+//
+// A mismatch is normal for most access points. The SMP lists the AP's
+// PEPPOL certificate, which signs AS4 messages and chains to the PEPPOL CA,
+// while HTTPS is usually served with a certificate from a public CA. Only
+// access points that reuse their PEPPOL certificate for TLS pass.
+func (c *Client) VerifyEndpointCertificate(ctx context.Context, endpoint Endpoint) error {
+	published, err := endpoint.ParseCertificate()
+	if err != nil {
+		return err
+	}
+
+	u := endpoint.URL
+	if u == nil {
+		if u, err = parseEndpointURL(endpoint.Address); err != nil {
+			return err
+		}
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("endpoint address %q does not use TLS", endpoint.Address)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	// The presented certificate is compared below rather than trusted, so
+	// the handshake isn't verified here
+	conn, err := c.dialTLS(ctx, address, &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	presented := conn.ConnectionState().PeerCertificates
+	if len(presented) == 0 {
+		return fmt.Errorf("%s presented no certificate", address)
+	}
+	if !presented[0].Equal(published) {
+		return &CertificateMismatchError{
+			Address:   endpoint.Address,
+			Published: certificateInfo(published).SHA256Fingerprint,
+			Presented: certificateInfo(presented[0]).SHA256Fingerprint,
+		}
+	}
+	return nil
+}
+
+// endpointDialTimeout bounds each connection attempt of
+// CheckEndpointReachable
+const endpointDialTimeout = 10 * time.Second
+
+// EndpointReachability is whether an access point accepted a connection
+type EndpointReachability struct {
+	Address          string           `json:"address"`
+	TransportProfile TransportProfile `json:"transport_profile"`
+	DocumentTypes    []string         `json:"document_types"` // the document types served at Address
+	Reachable        bool             `json:"reachable"`
+	Latency          time.Duration    `json:"latency,omitempty"` // time to connect, including any TLS handshake
+	Error            string           `json:"error,omitempty"`
+}
+
+// CheckEndpointReachable connects to the endpoint's address and, for https
+// addresses, completes a TLS handshake, then hangs up without sending
+// anything. It returns how long connecting took. Like
+// VerifyEndpointCertificate it contacts the access point itself, so it is
+// opt-in.
+func (c *Client) CheckEndpointReachable(ctx context.Context, endpoint Endpoint) (time.Duration, error) {
+	u := endpoint.URL
+	if u == nil {
+		var err error
+		if u, err = parseEndpointURL(endpoint.Address); err != nil {
+			return 0, err
+		}
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	address := net.JoinHostPort(u.Hostname(), port)
+
+	ctx, cancel := context.WithTimeout(ctx, endpointDialTimeout)
+	defer cancel()
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if u.Scheme == "https" {
+		// Only whether the handshake completes matters here, not whether
+		// the TLS certificate is trusted
+		conn, err = c.dialTLS(ctx, address, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: true,
+		})
+	} else {
+		conn, err = c.dialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to %s: %v", address, err)
+	}
+	latency := time.Since(start)
+	conn.Close()
+	return latency, nil
+}
+
+// EndpointReachability checks each distinct endpoint address in
+// capabilities with CheckEndpointReachable, concurrently, and returns the
+// outcomes sorted by address
+func (c *Client) EndpointReachability(ctx context.Context, capabilities *FullCapabilities) []EndpointReachability {
+	byAddress := make(map[string]*EndpointReachability)
+	endpoints := make(map[string]Endpoint)
+	for _, service := range capabilities.Services {
+		for _, process := range service.Processes {
+			for _, endpoint := range process.Endpoints {
+				r, ok := byAddress[endpoint.Address]
+				if !ok {
+					r = &EndpointReachability{Address: endpoint.Address, TransportProfile: endpoint.TransportProfile}
+					byAddress[endpoint.Address] = r
+					endpoints[endpoint.Address] = endpoint
+				}
+				if !slices.Contains(r.DocumentTypes, service.DocumentType) {
+					r.DocumentTypes = append(r.DocumentTypes, service.DocumentType)
+				}
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for address, r := range byAddress {
+		wg.Add(1)
+		go func(endpoint Endpoint, r *EndpointReachability) {
+			defer wg.Done()
+			latency, err := c.CheckEndpointReachable(ctx, endpoint)
+			if err != nil {
+				r.Error = err.Error()
+				return
+			}
+			r.Reachable, r.Latency = true, latency
+		}(endpoints[address], r)
+	}
+	wg.Wait()
+
+	results := make([]EndpointReachability, 0, len(byAddress))
+	for _, r := range byAddress {
+		results = append(results, *r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Address < results[j].Address })
+	return results
+}
+
+// tlsCertificates summarizes the certificate chain presented in a TLS
+// handshake, or returns nil for a connection without TLS
+func tlsCertificates(state *tls.ConnectionState) []*CertificateInfo {
+	if state == nil {
+		return nil
+	}
+	chain := make([]*CertificateInfo, len(state.PeerCertificates))
+	for i, cert := range state.PeerCertificates {
+		chain[i] = certificateInfo(cert)
+	}
+	return chain
+}
+
+// SMPTLSCertificates connects to the SMP at smpBaseURL and returns the
+// certificate chain it presents, leaf first, without verifying it. Unlike
+// DebugInfo.TLSCertificates, this works when the chain fails verification,
+// to diagnose SMP TLS problems apart from access point certificates.
+func (c *Client) SMPTLSCertificates(ctx context.Context, smpBaseURL string) ([]*CertificateInfo, error) {
+	u, err := url.Parse(smpBaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMP base URL %q: %v", smpBaseURL, err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("SMP %q does not use TLS", smpBaseURL)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	conn, err := c.dialTLS(ctx, address, &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", address, err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	return tlsCertificates(&state), nil
+}
+
+// CertificatePEM returns the endpoint's certificate PEM-encoded, ready for
+// openssl or a keystore tool
+func (e Endpoint) CertificatePEM() (string, error) {
+	cert, err := e.ParseCertificate()
+	if err != nil {
+		return "", err
+	}
+	return certificatePEM(cert), nil
+}
+
+// certificatePEM PEM-encodes cert
+func certificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// certificateInfo summarizes cert for display and archival
+func certificateInfo(cert *x509.Certificate) *CertificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &CertificateInfo{
+		PEM:               certificatePEM(cert),
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      cert.SerialNumber.String(),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+// MarshalJSON renders the certificate as PEM plus a parsed summary
+func (e Endpoint) MarshalJSON() ([]byte, error) {
+	out := struct {
+		TransportProfile TransportProfile `json:"transport_profile"`
+		Address          string           `json:"address"`
+		ActivationDate   *time.Time       `json:"activation_date,omitempty"`
+		ExpirationDate   *time.Time       `json:"expiration_date,omitempty"`
+		Certificate      *CertificateInfo `json:"certificate,omitempty"`
+		CertificateError string           `json:"certificate_error,omitempty"`
+
+		ServiceDescription         string `json:"service_description,omitempty"`
+		TechnicalContactURL        string `json:"technical_contact_url,omitempty"`
+		MinimumAuthenticationLevel string `json:"minimum_authentication_level,omitempty"`
+
+		CertExpiresInDays *int `json:"cert_expires_in_days,omitempty"`
+		CertExpiringSoon  bool `json:"cert_expiring_soon"`
+		CertExpired       bool `json:"cert_expired"`
+	}{
+		TransportProfile:           e.TransportProfile,
+		Address:                    e.Address,
+		ServiceDescription:         e.ServiceDescription,
+		TechnicalContactURL:        e.TechnicalContactURL,
+		MinimumAuthenticationLevel: e.MinimumAuthenticationLevel,
+	}
+	if !e.ActivationDate.IsZero() {
+		out.ActivationDate = &e.ActivationDate
+	}
+	if !e.ExpirationDate.IsZero() {
+		out.ExpirationDate = &e.ExpirationDate
+	}
+	if e.Certificate != "" {
+		cert, err := e.ParseCertificate()
+		if err != nil {
+			out.CertificateError = err.Error()
+		} else {
+			out.Certificate = certificateInfo(cert)
+			out.CertExpiresInDays = &e.CertExpiresInDays
+			out.CertExpiringSoon = e.CertExpiringSoon
+			out.CertExpired = e.CertExpired
+		}
+	}
+	return json.Marshal(out)
+}
+
+// IsActive reports whether t falls within the endpoint's
+// activation/expiration window
+func (e Endpoint) IsActive(t time.Time) bool {
+	if !e.ActivationDate.IsZero() && t.Before(e.ActivationDate) {
+		return false
+	}
+	if !e.ExpirationDate.IsZero() && !t.Before(e.ExpirationDate) {
+		return false
+	}
+	return true
+}
+
+// Process is a business process a document type is received under
+type Process struct {
+	ID        string     `json:"id"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// ServiceMetadata describes how a participant receives one document type
+type ServiceMetadata struct {
+	DocumentType string    `json:"document_type"`
+	Processes    []Process `json:"processes"`
+}
+
+// TransportProfile is a transport profile identifier, such as
+// TransportProfileAS4. Compare profiles with the constants below rather
+// than with strings.
+type TransportProfile string
+
+// PEPPOL and OASIS transport profile identifiers
+const (
+	TransportProfileAS4     TransportProfile = "peppol-transport-as4-v2_0"
+	TransportProfileAS2     TransportProfile = "busdox-transport-as2-ver2p0"
+	TransportProfileAS2v1   TransportProfile = "busdox-transport-as2-ver1p0"
+	TransportProfileBDXRAS4 TransportProfile = "bdxr-transport-ebms3-as4-v1p0"
+	TransportProfileSTART   TransportProfile = "busdox-transport-start"
+)
+
+// knownTransportProfiles are the TransportProfile constants
+var knownTransportProfiles = []TransportProfile{
+	TransportProfileAS4, TransportProfileAS2, TransportProfileAS2v1, TransportProfileBDXRAS4, TransportProfileSTART,
+}
+
+// ParseTransportProfile returns the constant for a transport profile
+// identifier, ignoring surrounding space and case. An unknown identifier
+// is kept as is (trimmed), with Known false, so SMPs can still publish
+// profiles added after this package.
+func ParseTransportProfile(id string) TransportProfile {
+	id = strings.TrimSpace(id)
+	for _, profile := range knownTransportProfiles {
+		if strings.EqualFold(id, string(profile)) {
+			return profile
+		}
+	}
+	return TransportProfile(id)
+}
+
+// Known reports whether p is one of the TransportProfile constants
+func (p TransportProfile) Known() bool {
+	return slices.Contains(knownTransportProfiles, p)
+}
+
+// DefaultTransportPreference is the endpoint preference used when a
+// Client's TransportPreference is empty: AS4 over AS2
+var DefaultTransportPreference = []TransportProfile{TransportProfileAS4, TransportProfileAS2, TransportProfileAS2v1}
+
+// CheckTransportPreference returns a warning for each profile in
+// preference that isn't a known transport profile identifier, which is
+// likely a typo. Unknown profiles still work: an SMP may publish them.
+func CheckTransportPreference(preference []TransportProfile) []string {
+	var warnings []string
+	for _, profile := range preference {
+		if !profile.Known() {
+			warnings = append(warnings, fmt.Sprintf("unknown transport profile %q", profile))
+		}
+	}
+	return warnings
+}
+
+// PreferredEndpoint returns the endpoint whose transport profile comes
+// first in preference, across all processes. Endpoints with profiles not in
+// preference rank last; ties go to the first published. It returns nil if
+// the service has no endpoints.
+func (m ServiceMetadata) PreferredEndpoint(preference []TransportProfile) *Endpoint {
+	var best *Endpoint
+	bestRank := 0
+	for i := range m.Processes {
+		for j := range m.Processes[i].Endpoints {
+			e := &m.Processes[i].Endpoints[j]
+			rank := slices.Index(preference, e.TransportProfile)
+			if rank < 0 {
+				rank = len(preference)
+			}
+			if best == nil || rank < bestRank {
+				best, bestRank = e, rank
+			}
+		}
+	}
+	return best
+}
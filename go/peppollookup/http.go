@@ -0,0 +1,366 @@
+package peppollookup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/proxy"
+)
+
+// httpClient returns HTTPClient, giving it a transport built from the
+// client's TLS options if it has none
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient.Transport != nil {
+		return c.HTTPClient
+	}
+	c.state.transportOnce.Do(func() {
+		c.state.transport = c.newTransport(&tls.Config{
+			RootCAs:            c.RootCAs,
+			MinVersion:         c.MinTLSVersion,
+			InsecureSkipVerify: c.InsecureSkipVerify,
+		})
+	})
+	client := *c.HTTPClient
+	client.Transport = c.state.transport
+	return &client
+}
+
+// Transport returns the transport SMP requests go through: HTTPClient's, or
+// the one built from the client's TLS and proxy options if it has none
+func (c *Client) Transport() http.RoundTripper {
+	return c.httpClient().Transport
+}
+
+// newTransport returns a transport for SMP and Directory requests with the
+// given TLS settings. HTTP/2 is negotiated over TLS unless ForceHTTP1 is
+// set; with a custom TLSClientConfig, net/http only attempts it when
+// ForceAttemptHTTP2 is on.
+func (c *Client) newTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = !c.ForceHTTP1
+	if c.ForceHTTP1 {
+		// A non-nil, empty TLSNextProto keeps HTTP/2 from being negotiated
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if c.SOCKS5Proxy != "" {
+		// The tunnel replaces any HTTP proxy from the environment
+		transport.Proxy = nil
+		transport.DialContext = c.dialContext
+	}
+	return transport
+}
+
+// dialTLS opens a TLS connection to address with config, through
+// SOCKS5Proxy if one is set
+func (c *Client) dialTLS(ctx context.Context, address string, config *tls.Config) (*tls.Conn, error) {
+	raw, err := c.dialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SOCKS5ProxyURL parses SOCKS5Proxy, accepting a bare "host:port"
+func (c *Client) SOCKS5ProxyURL() (*url.URL, error) {
+	raw := c.SOCKS5Proxy
+	if !strings.Contains(raw, "://") {
+		raw = "socks5://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 proxy %q: %v", c.SOCKS5Proxy, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("invalid SOCKS5 proxy %q: scheme must be socks5", c.SOCKS5Proxy)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("invalid SOCKS5 proxy %q: missing port", c.SOCKS5Proxy)
+	}
+	return u, nil
+}
+
+// dialContext opens a TCP connection to address, through SOCKS5Proxy if
+// one is set. Hostnames are passed to the proxy as they are, so the proxy
+// resolves them.
+func (c *Client) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if c.SOCKS5Proxy == "" {
+		return dialer.DialContext(ctx, network, address)
+	}
+	proxyURL, err := c.SOCKS5ProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", proxyURL.Host, err)
+	}
+	conn, err := socks.(proxy.ContextDialer).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", proxyURL.Host, err)
+	}
+	return conn, nil
+}
+
+// resolver returns the resolver for SML lookups. Through a SOCKS5 proxy,
+// queries go over TCP (SOCKS5 CONNECT can't carry UDP) to DNSServer or the
+// nameserver from /etc/resolv.conf.
+func (c *Client) resolver() *net.Resolver {
+	if c.SOCKS5Proxy == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if c.DNSServer != "" {
+				address = c.DNSServer
+			}
+			// A stream connection makes the resolver use TCP framing
+			return c.dialContext(ctx, "tcp", address)
+		},
+	}
+}
+
+// Accept headers for SMP documents
+const (
+	acceptXML  = "application/xml, text/xml;q=0.9"
+	acceptJSON = "application/json, application/xml;q=0.9, text/xml;q=0.8"
+)
+
+// get performs a rate-limited GET request for an SMP document and returns
+// the response body
+func (c *Client) get(ctx context.Context, urlStr string) ([]byte, error) {
+	return c.getAccepting(ctx, urlStr, acceptXML)
+}
+
+// getAccepting is get with the given Accept header
+func (c *Client) getAccepting(ctx context.Context, urlStr, accept string) ([]byte, error) {
+	body, _, err := c.getContent(ctx, urlStr, accept)
+	return body, err
+}
+
+// getSMPDocument fetches a ServiceGroup or ServiceMetadata document, in
+// JSON if PreferJSON is set, and reports whether the response is JSON
+func (c *Client) getSMPDocument(ctx context.Context, urlStr string) (body []byte, isJSON bool, err error) {
+	ctx, span := c.startSpan(ctx, "smp.fetch")
+	span.SetAttributes(attribute.String("http.url", urlStr))
+	if u, err := url.Parse(urlStr); err == nil {
+		span.SetAttributes(attribute.String("peppol.smp_host", u.Hostname()))
+	}
+	defer func() {
+		var statusErr *statusError
+		switch {
+		case errors.As(err, &statusErr):
+			span.SetAttributes(attribute.Int("http.status_code", statusErr.StatusCode))
+		case err == nil:
+			span.SetAttributes(attribute.Int("http.status_code", http.StatusOK))
+		}
+		endSpan(span, err)
+	}()
+
+	accept := acceptXML
+	if c.PreferJSON {
+		accept = acceptJSON
+	}
+	body, contentType, err := c.getContent(ctx, urlStr, accept)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, isJSONContent(contentType, body), nil
+}
+
+// isJSONContent reports whether a response is JSON, going by its
+// Content-Type or, if there is none, by its first character
+func isJSONContent(contentType string, body []byte) bool {
+	if contentType == "" {
+		trimmed := bytes.TrimSpace(body)
+		return len(trimmed) > 0 && trimmed[0] == '{'
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// getContent is getAccepting that also returns the response Content-Type
+func (c *Client) getContent(ctx context.Context, urlStr, accept string) ([]byte, string, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, maxRedirectsKey{}, c.MaxRedirects),
+		http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid URL %s: %v", urlStr, err)
+	}
+	host := strings.ToLower(req.URL.Host)
+	if err := c.allow(host); err != nil {
+		return nil, "", err
+	}
+
+	// Setting Accept-Encoding ourselves turns off net/http's transparent
+	// gzip handling, so the body is decoded in decodeBody below
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	req.Header.Set("Accept", accept)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+
+	// Perform HTTP GET request
+	debug, _ := ctx.Value(debugInfoKey{}).(*DebugInfo)
+	if debug != nil {
+		debug.RequestURL = urlStr
+	}
+	resp, err := c.httpClient().Do(req)
+	if ctx.Err() == nil {
+		// Cancellation says nothing about the host's health
+		c.record(host, err != nil || resp.StatusCode >= 500)
+	}
+	if isTLSVersionError(err) {
+		return nil, "", fmt.Errorf("failed to fetch %s: server does not support %s or later: %v",
+			urlStr, tls.VersionName(c.MinTLSVersion), err)
+	}
+	var redirectErr *RedirectError
+	if errors.As(err, &redirectErr) {
+		return nil, "", fmt.Errorf("failed to fetch %s: %w", urlStr, redirectErr)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch %s: %v", urlStr, err)
+	}
+	defer resp.Body.Close()
+	if debug != nil {
+		// resp.Request is the last request made, after any redirects
+		debug.FinalURL = resp.Request.URL.String()
+		debug.StatusCode = resp.StatusCode
+		debug.TLSCertificates = tlsCertificates(resp.TLS)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &statusError{StatusCode: resp.StatusCode, URL: urlStr}
+	}
+
+	// Read response body
+	body, err := c.decodeBody(resp)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read response body from %s: %v", urlStr, err)
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// decodeBody reads a response body, undoing any gzip or deflate
+// Content-Encoding, and enforces MaxResponseSize on the decoded size
+//
+// The size is counted as the body is read, so the limit holds for chunked
+// responses without a Content-Length too; net/http has removed the
+// chunking by then. A Content-Length already over the limit fails before
+// reading. A body cut off before its last chunk or its Content-Length is
+// an error, not a short document.
+func (c *Client) decodeBody(resp *http.Response) ([]byte, error) {
+	var reader io.Reader = resp.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		if c.MaxResponseSize > 0 && resp.ContentLength > c.MaxResponseSize {
+			return nil, fmt.Errorf("response exceeds %d bytes (Content-Length %d)", c.MaxResponseSize, resp.ContentLength)
+		}
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send raw DEFLATE
+		buffered := bufio.NewReader(resp.Body)
+		header, err := buffered.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(buffered)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			reader = zr
+		} else {
+			fr := flate.NewReader(buffered)
+			defer fr.Close()
+			reader = fr
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	if c.MaxResponseSize <= 0 {
+		body, err := io.ReadAll(reader)
+		return body, truncatedBodyError(resp, err)
+	}
+	// Read one byte past the limit to tell a full-size body from an oversized one
+	body, err := io.ReadAll(io.LimitReader(reader, c.MaxResponseSize+1))
+	if err != nil {
+		return nil, truncatedBodyError(resp, err)
+	}
+	if int64(len(body)) > c.MaxResponseSize {
+		return nil, fmt.Errorf("response exceeds %d bytes", c.MaxResponseSize)
+	}
+	return body, nil
+}
+
+// alertProtocolVersion is the TLS protocol_version alert (RFC 8446,
+// section 6)
+const alertProtocolVersion = 70
+
+// isTLSVersionError reports whether err is a TLS handshake that failed
+// with a protocol_version alert, because client and server share no TLS
+// version
+func isTLSVersionError(err error) bool {
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		return alertErr == alertProtocolVersion
+	}
+	// Over TCP, crypto/tls reports an alert as a *net.OpError wrapping its
+	// unexported alert type, a uint8
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || (opErr.Op != "remote error" && opErr.Op != "local error") || opErr.Err == nil {
+		return false
+	}
+	alert := reflect.ValueOf(opErr.Err)
+	return alert.Kind() == reflect.Uint8 && alert.Uint() == alertProtocolVersion
+}
+
+// truncatedBodyError describes a body read error caused by the connection
+// closing mid-response, and returns other errors unchanged
+func truncatedBodyError(resp *http.Response, err error) error {
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	if resp.ContentLength < 0 {
+		return fmt.Errorf("connection closed before the end of the chunked response: %v", err)
+	}
+	return fmt.Errorf("connection closed before the %d bytes of Content-Length were sent: %v", resp.ContentLength, err)
+}
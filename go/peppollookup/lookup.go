@@ -0,0 +1,365 @@
+package peppollookup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrNotRegistered is returned when the SML has no record of a participant
+var ErrNotRegistered = errors.New("participant is not registered in PEPPOL")
+
+// NotFoundReason explains why a participant could not be found
+type NotFoundReason int
+
+const (
+	// ReasonNXDOMAIN means the SML has no DNS record for the participant,
+	// i.e. they are not registered
+	ReasonNXDOMAIN NotFoundReason = iota + 1
+
+	// ReasonNoServices means the SML record exists but does not resolve to
+	// an address, which points to a misconfigured registration
+	ReasonNoServices
+
+	// ReasonSMPEmpty means the SMP has no ServiceGroup for the participant
+	// or it lists no document types
+	ReasonSMPEmpty
+)
+
+func (r NotFoundReason) String() string {
+	switch r {
+	case ReasonNXDOMAIN:
+		return "not registered in the SML"
+	case ReasonNoServices:
+		return "registered in the SML but the SMP hostname does not resolve"
+	case ReasonSMPEmpty:
+		return "registered but the SMP publishes no document types"
+	default:
+		return "not found"
+	}
+}
+
+// ErrNoDocuments is matched by a *NotFoundError with ReasonSMPEmpty: the
+// participant is registered but publishes no document types
+var ErrNoDocuments = errors.New("participant publishes no document types")
+
+// NotFoundError is returned when a participant cannot be found.
+// errors.Is(err, ErrNotRegistered) holds for ReasonNXDOMAIN and
+// errors.Is(err, ErrNoDocuments) for ReasonSMPEmpty.
+type NotFoundError struct {
+	ParticipantID string
+	Reason        NotFoundReason
+
+	// DNSName is the SML name that was queried, e.g. for checking with dig
+	DNSName string
+
+	// Warning explains a likely mix-up, such as looking up a production
+	// participant in the test SML; empty if there's nothing to add
+	Warning string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("participant %s is %s", e.ParticipantID, e.Reason)
+}
+
+// Is matches ErrNotRegistered and ErrNoDocuments by reason
+func (e *NotFoundError) Is(target error) bool {
+	switch target {
+	case ErrNotRegistered:
+		return e.Reason == ReasonNXDOMAIN
+	case ErrNoDocuments:
+		return e.Reason == ReasonSMPEmpty
+	}
+	return false
+}
+
+// statusError is returned when an SMP or the Directory responds with a
+// non-200 status
+type statusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("HTTP %d from %s", e.StatusCode, e.URL)
+}
+
+// Result is the outcome of looking up a participant
+type Result struct {
+	ParticipantID string   `json:"participant_id"`
+	SMPHostname   string   `json:"smp_hostname"`
+	DocumentTypes []string `json:"document_types"`
+	SMPVersion    string   `json:"smp_version,omitempty"` // "1.0" or "2.0"; empty with SMLOnly
+
+	// DNSName is the lowercase SML name that was queried, as given by
+	// Client.DNSName, for cross-checking with tools such as dig
+	DNSName string `json:"dns_name"`
+
+	// MetadataReferences are the absolute ServiceMetadata URLs the
+	// ServiceGroup lists, one per document type, for fetching specific
+	// metadata directly. SMP 2.0 ServiceGroups list none, so these are
+	// built from the document identifiers.
+	MetadataReferences []string `json:"metadata_references,omitempty"`
+
+	// Capabilities names the registered DocumentMatchers the participant's
+	// document types satisfy, e.g. "BIS Billing 3.0 Invoice"
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// NationalProfiles lists the country-specific profiles, such as the
+	// Norwegian EHF profiles, among the participant's document types
+	NationalProfiles []NationalProfile `json:"national_profiles,omitempty"`
+
+	// Name and Country come from the participant's business card in the
+	// PEPPOL Directory, or from the SMP's own business card when the
+	// Directory has none, and are empty when neither is available or
+	// Client.EnrichResults is off. Country is an uppercase ISO 3166-1
+	// alpha-2 code.
+	Name    string `json:"name,omitempty"`
+	Country string `json:"country,omitempty"`
+
+	// SMLHashForm is which form of the participant ID the SML resolved:
+	// SMLHashNormalized, or SMLHashAsGiven if only Client.CaseFallback
+	// found the participant
+	SMLHashForm string `json:"sml_hash_form,omitempty"`
+
+	// Warnings lists non-fatal problems, such as a Directory outage
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Debug describes how the SMP answered the ServiceGroup request
+	Debug *DebugInfo `json:"debug,omitempty"`
+}
+
+// Lookup resolves a participant and lists the document types they support.
+// Only with EnrichResults set does it also add their business card from the
+// PEPPOL Directory; otherwise Name and Country are left empty.
+//
+// Business card enrichment is best-effort: if the Directory cannot be
+// reached, Name and Country are left empty and a warning is recorded, but
+// the SML/SMP result is still returned.
+//
+// With ResultHardTTL set, successful results are cached; see ResultSoftTTL.
+// opts override the client's settings for this call only.
+func (c *Client) Lookup(ctx context.Context, icd, identifier string, opts ...LookupOption) (result *Result, err error) {
+	c, ctx, cancel := c.withOptions(ctx, opts)
+	defer cancel()
+
+	ctx, span := c.startSpan(ctx, "peppol.Lookup")
+	span.SetAttributes(attribute.String("peppol.participant_id", canonicalParticipantID(icd, identifier)))
+	fromCache := false
+	defer func() {
+		if result != nil {
+			span.SetAttributes(attribute.String("peppol.smp_host", result.SMPHostname))
+		}
+		endSpan(span, err)
+		if result != nil {
+			c.audit(icd, identifier, result.SMPHostname, result.DocumentTypes, fromCache, err)
+		} else {
+			c.audit(icd, identifier, "", nil, fromCache, err)
+		}
+	}()
+
+	if c.Cache == nil || c.ResultHardTTL <= 0 {
+		return c.lookup(ctx, icd, identifier)
+	}
+
+	cacheKey := c.resultCacheKey(icd, identifier, c.SMLOnly)
+	if value, ok := c.Cache.Get(cacheKey); ok {
+		var cached cachedResult
+		if err := json.Unmarshal([]byte(value), &cached); err == nil && cached.Result != nil {
+			if time.Since(cached.Fetched) > c.ResultSoftTTL {
+				c.refreshInBackground(ctx, cacheKey, icd, identifier)
+			}
+			fromCache = true
+			return cached.Result, nil
+		}
+	}
+
+	result, err = c.lookup(ctx, icd, identifier)
+	if err != nil {
+		return nil, err
+	}
+	c.cacheResult(cacheKey, result)
+	return result, nil
+}
+
+// AuditRecord is one line of Client.AuditLog, recording a Lookup or
+// FullCapabilities call
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	RequestedID  string    `json:"requested_id"`  // the participant ID as passed in
+	NormalizedID string    `json:"normalized_id"` // the ID the SML hostname is derived from
+	DNSName      string    `json:"dns_name"`      // the participant's SML hostname
+	SMPURL       string    `json:"smp_url,omitempty"`
+
+	// Outcome is "found", "not_registered", "no_documents" or "error"
+	Outcome       string   `json:"outcome"`
+	Cached        bool     `json:"cached"` // answered from the result cache
+	DocumentTypes []string `json:"document_types,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// audit writes the AuditRecord of a call to AuditLog, if set. smlHostname
+// is the SML hostname the participant resolved to, if any. Write errors are
+// ignored so an unwritable log doesn't fail lookups.
+func (c *Client) audit(icd, identifier, smlHostname string, documentTypes []string, cached bool, err error) {
+	if c.AuditLog == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:         time.Now().UTC(),
+		RequestedID:  icd + ":" + identifier,
+		NormalizedID: canonicalParticipantID(icd, identifier),
+		DNSName:      c.participantHostname(icd, identifier),
+		Outcome:      "found",
+		Cached:       cached,
+	}
+	if smlHostname != "" {
+		record.DNSName = smlHostname
+		record.SMPURL = SMPHostURL(smlHostname)
+		record.DocumentTypes = documentTypes
+	}
+	switch {
+	case errors.Is(err, ErrNotRegistered):
+		record.Outcome = "not_registered"
+	case errors.Is(err, ErrNoDocuments):
+		record.Outcome = "no_documents"
+	case err != nil:
+		record.Outcome = "error"
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	line, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		return
+	}
+	c.state.auditMu.Lock()
+	defer c.state.auditMu.Unlock()
+	c.AuditLog.Write(append(line, '\n'))
+}
+
+// lookup is Lookup without result caching
+func (c *Client) lookup(ctx context.Context, icd, identifier string) (*Result, error) {
+	smpHostname, err := c.smlLookup(ctx, icd, identifier)
+	if err != nil {
+		return nil, c.checkProductionSML(ctx, icd, identifier, err)
+	}
+	hashForm := c.smlHashForm(icd, identifier, smpHostname)
+	var warnings []string
+	if hashForm == SMLHashAsGiven {
+		warnings = append(warnings, fmt.Sprintf("SML only has %s:%s registered with its casing kept, not lowercased", icd, identifier))
+	}
+	if c.SMLOnly {
+		return &Result{
+			ParticipantID: fmt.Sprintf("%s:%s", icd, identifier),
+			SMPHostname:   smpHostname,
+			DNSName:       smpHostname,
+			SMLHashForm:   hashForm,
+			Warnings:      warnings,
+		}, nil
+	}
+
+	debug := &DebugInfo{}
+	if c.MaxCNAMEDepth > 0 {
+		chain, err := c.ResolveCNAMEChain(ctx, smpHostname)
+		if errors.Is(err, ErrCNAMEChainTooLong) {
+			return nil, err
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("CNAME chain unavailable: %v", err))
+		}
+		debug.CNAMEChain = chain
+	}
+	if c.DebugDNS {
+		records, err := c.DNSAnswers(ctx, icd, identifier)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("DNS answers incomplete: %v", err))
+		}
+		debug.DNSAnswers = records
+	}
+
+	hrefs, version, err := c.fetchServiceGroup(withDebugInfo(ctx, debug), SMPHostURL(smpHostname), icd, identifier)
+	if err != nil {
+		var notFound *NotFoundError
+		if errors.As(err, &notFound) {
+			notFound.DNSName = smpHostname
+		}
+		return nil, err
+	}
+	warnings = append(warnings, c.serviceGroupWarnings(debug, icd, identifier)...)
+	if hrefs, err = c.liveHrefs(ctx, hrefs); err != nil {
+		return nil, err
+	}
+
+	// Report document types without their customization, as
+	// DocumentTypesViaSMP does, but match capabilities against the full
+	// identifiers
+	documentTypes := make([]string, 0, len(hrefs))
+	fullDocumentTypes := make([]string, 0, len(hrefs))
+	for _, href := range hrefs {
+		if docType, ok := documentTypeFromHref(href); ok {
+			fullDocumentTypes = append(fullDocumentTypes, docType)
+			documentTypes = append(documentTypes, strings.Split(docType, "#")[0])
+		}
+	}
+
+	result := &Result{
+		ParticipantID: fmt.Sprintf("%s:%s", icd, identifier),
+		SMPHostname:   smpHostname,
+		DNSName:       smpHostname,
+		DocumentTypes: documentTypes,
+		SMPVersion:    version,
+		Capabilities:  matchCapabilities(fullDocumentTypes),
+		SMLHashForm:   hashForm,
+		Warnings:      warnings,
+
+		MetadataReferences: hrefs,
+		Debug:              debug,
+
+		NationalProfiles: SupportedNationalProfiles(fullDocumentTypes),
+	}
+
+	if c.CheckSMLConsistency {
+		if warning := c.checkSMLConsistency(ctx, icd, identifier, smpHostname); warning != "" {
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+
+	if c.EnrichResults {
+		var warnings []string
+		result.Name, result.Country, warnings = c.participantDetails(ctx, smpHostname, icd, identifier)
+		result.Warnings = append(result.Warnings, warnings...)
+	}
+	return result, nil
+}
+
+// participantDetails returns a participant's name and country from their
+// business card in the Directory, or on their SMP at smpHostname when the
+// Directory has none. Failures are returned as warnings.
+func (c *Client) participantDetails(ctx context.Context, smpHostname, icd, identifier string) (name, country string, warnings []string) {
+	if c.DirectoryURL != "" {
+		var err error
+		name, country, err = c.BusinessCard(ctx, icd, identifier)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("business card unavailable: %v", err))
+		}
+		country = countryCode(country)
+	}
+	if country == "" {
+		smpName, smpCountry, err := c.smpBusinessCard(ctx, SMPHostURL(smpHostname), icd, identifier)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("SMP business card unavailable: %v", err))
+		}
+		if name == "" {
+			name = smpName
+		}
+		country = countryCode(smpCountry)
+	}
+	return name, country, warnings
+}
@@ -0,0 +1,248 @@
+package peppollookup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Production SML domain
+const smlDomain = "edelivery.tech.ec.europa.eu"
+
+// Test (acceptance) SML domain
+const testSMLDomain = "acc.edelivery.tech.ec.europa.eu"
+
+// Identifier scheme of PEPPOL participant identifiers
+const participantScheme = "iso6523-actorid-upis"
+
+// Prefix of the hashed label of SML hostnames
+const smlHostnamePrefix = "b-"
+
+// PEPPOL BIS Billing 3.0 document identifiers
+const (
+	BISBillingInvoice    = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2::Invoice"
+	BISBillingCreditNote = "urn:oasis:names:specification:ubl:schema:xsd:CreditNote-2::CreditNote"
+
+	// Full identifiers including the BIS Billing 3.0 customization, which
+	// can be queried directly on an SMP
+	BISBillingCustomization = "##urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0::2.1"
+	BISBillingInvoiceID     = BISBillingInvoice + BISBillingCustomization
+	BISBillingCreditNoteID  = BISBillingCreditNote + BISBillingCustomization
+)
+
+// Full identifiers of other common PEPPOL BIS 3.0 document types
+const (
+	BISBillingCIIInvoiceID    = "urn:un:unece:uncefact:data:standard:CrossIndustryInvoice:100::CrossIndustryInvoice##urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0::D16B"
+	BISOrderID                = "urn:oasis:names:specification:ubl:schema:xsd:Order-2::Order##urn:fdc:peppol.eu:poacc:trns:order:3::2.1"
+	BISOrderResponseID        = "urn:oasis:names:specification:ubl:schema:xsd:OrderResponse-2::OrderResponse##urn:fdc:peppol.eu:poacc:trns:order_response:3::2.1"
+	BISDespatchAdviceID       = "urn:oasis:names:specification:ubl:schema:xsd:DespatchAdvice-2::DespatchAdvice##urn:fdc:peppol.eu:poacc:trns:despatch_advice:3::2.1"
+	BISCatalogueID            = "urn:oasis:names:specification:ubl:schema:xsd:Catalogue-2::Catalogue##urn:fdc:peppol.eu:poacc:trns:catalogue:3::2.1"
+	BISMessageLevelResponseID = "urn:oasis:names:specification:ubl:schema:xsd:ApplicationResponse-2::ApplicationResponse##urn:fdc:peppol.eu:poacc:trns:mlr:3::2.1"
+)
+
+// ParticipantID identifies a PEPPOL participant within the ISO 6523 scheme
+type ParticipantID struct {
+	ICD        string // ISO 6523 scheme code, e.g. "0192"
+	Identifier string // identifier within the scheme, e.g. an organization number
+}
+
+// String returns the participant ID in "icd:identifier" form
+func (p ParticipantID) String() string {
+	return p.ICD + ":" + p.Identifier
+}
+
+// icdPattern is what a scheme code missing from the embedded scheme list
+// must look like to be accepted
+var icdPattern = regexp.MustCompile(`^[0-9A-Za-z]{2,10}$`)
+
+// ParseParticipantID parses a participant ID of the form "icd:identifier",
+// optionally prefixed with the "iso6523-actorid-upis::" scheme
+//
+// The ICD may be any code in the embedded scheme list (see ListSchemes).
+// Codes not in the list are accepted if they consist of 2 to 10 letters
+// or digits, so newly assigned schemes keep working.
+func ParseParticipantID(s string) (ParticipantID, error) {
+	value := strings.TrimPrefix(strings.TrimSpace(s), participantScheme+"::")
+	icd, identifier, ok := strings.Cut(value, ":")
+	if !ok || identifier == "" {
+		return ParticipantID{}, fmt.Errorf("invalid participant ID %q: expected icd:identifier", s)
+	}
+	if _, known := SchemeName(icd); !known && !icdPattern.MatchString(icd) {
+		return ParticipantID{}, fmt.Errorf("invalid participant ID %q: unknown ICD %q", s, icd)
+	}
+	if icd == ICDNorwayOrgNumber && !ValidNorwegianOrgNumber(norwegianOrgNumber(identifier)) {
+		return ParticipantID{}, fmt.Errorf("invalid participant ID %q: not a valid Norwegian organization number", s)
+	}
+	return ParticipantID{ICD: icd, Identifier: identifier}, nil
+}
+
+// Norwegian participants are registered under their organization number.
+// 0192 is the current scheme; 9908 is the legacy one, still found on older
+// registrations and ELMA test participants.
+const (
+	ICDNorwayOrgNumber = "0192"
+	ICDNorwayLegacy    = "9908"
+)
+
+// ValidNorwegianOrgNumber reports whether s is a nine-digit Norwegian
+// organization number with a valid modulus 11 check digit
+func ValidNorwegianOrgNumber(s string) bool {
+	if len(s) != 9 {
+		return false
+	}
+	weights := []int{3, 2, 7, 6, 5, 4, 3, 2}
+	sum := 0
+	for i, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+		if i < len(weights) {
+			sum += int(r-'0') * weights[i]
+		}
+	}
+	check := (11 - sum%11) % 11
+	return check != 10 && int(s[8]-'0') == check
+}
+
+// norwegianOrgNumber returns the organization number in identifier, which
+// may be written in its VAT number form, e.g. NO921605900MVA
+func norwegianOrgNumber(identifier string) string {
+	upper := strings.ToUpper(identifier)
+	if strings.HasPrefix(upper, "NO") && strings.HasSuffix(upper, "MVA") && len(upper) > 5 {
+		return upper[2 : len(upper)-3]
+	}
+	return identifier
+}
+
+// NorwegianAlternate returns p's organization number under the other
+// Norwegian scheme, e.g. 9908:921605900 for 0192:921605900, so callers can
+// retry a participant that isn't registered under the scheme they tried
+func NorwegianAlternate(p ParticipantID) (ParticipantID, bool) {
+	switch p.ICD {
+	case ICDNorwayOrgNumber:
+		return ParticipantID{ICD: ICDNorwayLegacy, Identifier: p.Identifier}, true
+	case ICDNorwayLegacy:
+		return ParticipantID{ICD: ICDNorwayOrgNumber, Identifier: p.Identifier}, true
+	}
+	return ParticipantID{}, false
+}
+
+// Scheme is an ISO 6523 ICD used for PEPPOL participant identifiers
+type Scheme struct {
+	ICD        string `json:"icd"`
+	Name       string `json:"name"`
+	Country    string `json:"country"` // ISO 3166 alpha-2 code, or "international"
+	Deprecated bool   `json:"deprecated,omitempty"`
+}
+
+// schemes is the PEPPOL participant identifier scheme code list, ordered
+// by ICD
+var schemes = []Scheme{
+	{ICD: "0002", Name: "SIRENE", Country: "FR"},
+	{ICD: "0007", Name: "Organisationsnummer", Country: "SE"},
+	{ICD: "0009", Name: "SIRET-CODE", Country: "FR"},
+	{ICD: "0037", Name: "LY-tunnus", Country: "FI"},
+	{ICD: "0060", Name: "DUNS number", Country: "international"},
+	{ICD: "0088", Name: "Global Location Number (GLN)", Country: "international"},
+	{ICD: "0096", Name: "DANISH CHAMBER OF COMMERCE Scheme (EDIRA compliant)", Country: "DK"},
+	{ICD: "0097", Name: "FTI - Ediforum Italia", Country: "IT"},
+	{ICD: "0106", Name: "Vereniging van Kamers van Koophandel en Fabrieken in Nederland", Country: "NL"},
+	{ICD: "0130", Name: "Directorates of the European Commission", Country: "international"},
+	{ICD: "0135", Name: "SIA Object Identifiers", Country: "IT"},
+	{ICD: "0142", Name: "SECETI Object Identifiers", Country: "IT"},
+	{ICD: "0151", Name: "Australian Business Number (ABN)", Country: "AU"},
+	{ICD: "0183", Name: "Swiss Unique Business Identification Number (UIDB)", Country: "CH"},
+	{ICD: "0184", Name: "DIGSTORG (CVR number)", Country: "DK"},
+	{ICD: "0188", Name: "Corporate Number of the Social Security and Tax Number System", Country: "JP"},
+	{ICD: "0190", Name: "Dutch Originator's Identification Number (OIN)", Country: "NL"},
+	{ICD: "0191", Name: "Centre of Registers and Information Systems of the Ministry of Justice", Country: "EE"},
+	{ICD: "0192", Name: "Enhetsregisteret ved Bronnoysundregisterne", Country: "NO"},
+	{ICD: "0193", Name: "UBL.BE party identifier", Country: "BE"},
+	{ICD: "0195", Name: "Singapore UEN identifier", Country: "SG"},
+	{ICD: "0196", Name: "Kennitala", Country: "IS"},
+	{ICD: "0198", Name: "ERSTORG", Country: "DK"},
+	{ICD: "0199", Name: "Legal Entity Identifier (LEI)", Country: "international"},
+	{ICD: "0200", Name: "Legal entity code", Country: "LT"},
+	{ICD: "0201", Name: "Codice Univoco Unità Organizzativa iPA", Country: "IT"},
+	{ICD: "0202", Name: "Indirizzo di Posta Elettronica Certificata", Country: "IT"},
+	{ICD: "0204", Name: "Leitweg-ID", Country: "DE"},
+	{ICD: "0208", Name: "Numero d'entreprise / ondernemingsnummer / Unternehmensnummer", Country: "BE"},
+	{ICD: "0209", Name: "GS1 identification keys", Country: "international"},
+	{ICD: "0210", Name: "Codice Fiscale", Country: "IT"},
+	{ICD: "0211", Name: "Partita IVA", Country: "IT"},
+	{ICD: "0212", Name: "Finnish Organization Identifier", Country: "FI"},
+	{ICD: "0213", Name: "Finnish Organization Value Add Tax Identifier", Country: "FI"},
+	{ICD: "0215", Name: "Net service ID", Country: "FI"},
+	{ICD: "0216", Name: "OVTcode", Country: "FI"},
+	{ICD: "0218", Name: "Unified registration number", Country: "LV"},
+	{ICD: "0221", Name: "Registered number of the qualified invoice issuer", Country: "JP"},
+	{ICD: "0230", Name: "National e-Invoicing Framework", Country: "MY"},
+	{ICD: "9901", Name: "Danish Ministry of the Interior and Health", Country: "DK", Deprecated: true},
+	{ICD: "9902", Name: "Danish CVR number", Country: "DK", Deprecated: true},
+	{ICD: "9904", Name: "Danish SE number", Country: "DK", Deprecated: true},
+	{ICD: "9906", Name: "Partita IVA", Country: "IT", Deprecated: true},
+	{ICD: "9907", Name: "Codice Fiscale", Country: "IT", Deprecated: true},
+	{ICD: "9908", Name: "Enhetsregisteret ved Bronnoysundregisterne", Country: "NO", Deprecated: true},
+	{ICD: "9909", Name: "Norwegian VAT number", Country: "NO", Deprecated: true},
+	{ICD: "9910", Name: "Hungary VAT number", Country: "HU"},
+	{ICD: "9912", Name: "VAT number (any EU member state)", Country: "international", Deprecated: true},
+	{ICD: "9913", Name: "Business Registers Network", Country: "international"},
+	{ICD: "9914", Name: "Österreichische Umsatzsteuer-Identifikationsnummer", Country: "AT"},
+	{ICD: "9915", Name: "Österreichisches Verwaltungs- bzw. Organisationskennzeichen", Country: "AT"},
+	{ICD: "9918", Name: "SOCIETY FOR WORLDWIDE INTERBANK FINANCIAL, TELECOMMUNICATION S.W.I.F.T", Country: "international"},
+	{ICD: "9919", Name: "Kennziffer des Unternehmensregisters", Country: "AT"},
+	{ICD: "9920", Name: "Agencia Española de Administración Tributaria", Country: "ES"},
+	{ICD: "9922", Name: "Andorra VAT number", Country: "AD"},
+	{ICD: "9923", Name: "Albania VAT number", Country: "AL"},
+	{ICD: "9924", Name: "Bosnia and Herzegovina VAT number", Country: "BA"},
+	{ICD: "9925", Name: "Belgium VAT number", Country: "BE"},
+	{ICD: "9926", Name: "Bulgaria VAT number", Country: "BG"},
+	{ICD: "9927", Name: "Switzerland VAT number", Country: "CH"},
+	{ICD: "9928", Name: "Cyprus VAT number", Country: "CY"},
+	{ICD: "9929", Name: "Czech Republic VAT number", Country: "CZ"},
+	{ICD: "9930", Name: "Germany VAT number", Country: "DE"},
+	{ICD: "9931", Name: "Estonia VAT number", Country: "EE"},
+	{ICD: "9932", Name: "United Kingdom VAT number", Country: "GB"},
+	{ICD: "9933", Name: "Greece VAT number", Country: "GR"},
+	{ICD: "9934", Name: "Croatia VAT number", Country: "HR"},
+	{ICD: "9935", Name: "Ireland VAT number", Country: "IE"},
+	{ICD: "9936", Name: "Liechtenstein VAT number", Country: "LI"},
+	{ICD: "9937", Name: "Lithuania VAT number", Country: "LT"},
+	{ICD: "9938", Name: "Luxemburg VAT number", Country: "LU"},
+	{ICD: "9939", Name: "Latvia VAT number", Country: "LV"},
+	{ICD: "9940", Name: "Monaco VAT number", Country: "MC"},
+	{ICD: "9941", Name: "Montenegro VAT number", Country: "ME"},
+	{ICD: "9942", Name: "Macedonia, the former Yugoslav Republic of VAT number", Country: "MK"},
+	{ICD: "9943", Name: "Malta VAT number", Country: "MT"},
+	{ICD: "9944", Name: "Netherlands VAT number", Country: "NL"},
+	{ICD: "9945", Name: "Poland VAT number", Country: "PL"},
+	{ICD: "9946", Name: "Portugal VAT number", Country: "PT"},
+	{ICD: "9947", Name: "Romania VAT number", Country: "RO"},
+	{ICD: "9948", Name: "Serbia VAT number", Country: "RS"},
+	{ICD: "9949", Name: "Slovenia VAT number", Country: "SI"},
+	{ICD: "9950", Name: "Slovakia VAT number", Country: "SK"},
+	{ICD: "9951", Name: "San Marino VAT number", Country: "SM"},
+	{ICD: "9952", Name: "Turkey VAT number", Country: "TR"},
+	{ICD: "9953", Name: "Holy See (Vatican City State) VAT number", Country: "VA"},
+	{ICD: "9955", Name: "Swedish VAT number", Country: "SE", Deprecated: true},
+	{ICD: "9956", Name: "Belgian Crossroad Bank of Enterprises number", Country: "BE", Deprecated: true},
+	{ICD: "9957", Name: "French VAT number", Country: "FR"},
+	{ICD: "9958", Name: "German Leitweg-ID", Country: "DE", Deprecated: true},
+	{ICD: "9959", Name: "Employer Identification Number (EIN)", Country: "US"},
+}
+
+// SchemeName returns the name of the ICD scheme, e.g. "Global Location
+// Number (GLN)" for "0088"
+func SchemeName(icd string) (string, bool) {
+	for _, scheme := range schemes {
+		if scheme.ICD == icd {
+			return scheme.Name, true
+		}
+	}
+	return "", false
+}
+
+// ListSchemes returns every known ICD scheme, ordered by code
+func ListSchemes() []Scheme {
+	return append([]Scheme(nil), schemes...)
+}
@@ -0,0 +1,930 @@
+package peppollookup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testServiceGroup lists the BIS Billing 3.0 Invoice and CreditNote of
+// 0192:921605900; HOST is replaced with the test SMP's URL
+const testServiceGroup = `<?xml version="1.0" encoding="UTF-8"?>
+<ServiceGroup xmlns="http://busdox.org/serviceMetadata/publishing/1.0/" xmlns:id="http://busdox.org/transport/identifiers/1.0/">
+  <id:ParticipantIdentifier scheme="iso6523-actorid-upis">0192:921605900</id:ParticipantIdentifier>
+  <ServiceMetadataReferenceCollection>
+    <ServiceMetadataReference href="HOST/iso6523-actorid-upis%3A%3A0192%3A921605900/services/busdox-docid-qns%3A%3Aurn%3Aoasis%3Anames%3Aspecification%3Aubl%3Aschema%3Axsd%3AInvoice-2%3A%3AInvoice%23%23urn%3Acen.eu%3Aen16931%3A2017%23compliant%23urn%3Afdc%3Apeppol.eu%3A2017%3Apoacc%3Abilling%3A3.0%3A%3A2.1"/>
+    <ServiceMetadataReference href="HOST/iso6523-actorid-upis%3A%3A0192%3A921605900/services/busdox-docid-qns%3A%3Aurn%3Aoasis%3Anames%3Aspecification%3Aubl%3Aschema%3Axsd%3ACreditNote-2%3A%3ACreditNote%23%23urn%3Acen.eu%3Aen16931%3A2017%23compliant%23urn%3Afdc%3Apeppol.eu%3A2017%3Apoacc%3Abilling%3A3.0%3A%3A2.1"/>
+  </ServiceMetadataReferenceCollection>
+</ServiceGroup>`
+
+// testServiceMetadata is the ServiceMetadata of document type DOC, with one
+// AS4 endpoint that expires at EXPIRES
+const testServiceMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<SignedServiceMetadata xmlns="http://busdox.org/serviceMetadata/publishing/1.0/" xmlns:id="http://busdox.org/transport/identifiers/1.0/" xmlns:wsa="http://www.w3.org/2005/08/addressing">
+  <ServiceMetadata>
+    <ServiceInformation>
+      <id:ParticipantIdentifier scheme="iso6523-actorid-upis">0192:921605900</id:ParticipantIdentifier>
+      <id:DocumentIdentifier scheme="busdox-docid-qns">DOC</id:DocumentIdentifier>
+      <ProcessList>
+        <Process>
+          <id:ProcessIdentifier scheme="cenbii-procid-ubl">urn:fdc:peppol.eu:2017:poacc:billing:01:1.0</id:ProcessIdentifier>
+          <ServiceEndpointList>
+            <Endpoint transportProfile="peppol-transport-as4-v2_0">
+              <wsa:EndpointReference><wsa:Address>https://ap.example.com/as4</wsa:Address></wsa:EndpointReference>
+              <RequireBusinessLevelSignature>false</RequireBusinessLevelSignature>
+              <ServiceActivationDate>2020-01-01T00:00:00Z</ServiceActivationDate>
+              <ServiceExpirationDate>EXPIRES</ServiceExpirationDate>
+              <Certificate>MIIB</Certificate>
+              <ServiceDescription>Example AP</ServiceDescription>
+              <TechnicalContactUrl>https://example.com/contact</TechnicalContactUrl>
+            </Endpoint>
+          </ServiceEndpointList>
+        </Process>
+      </ProcessList>
+    </ServiceInformation>
+  </ServiceMetadata>
+</SignedServiceMetadata>`
+
+// newTestSMP serves testServiceGroup and testServiceMetadata. The endpoints
+// of document types whose local name is in expired have expired.
+func newTestSMP(t *testing.T, expired ...string) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, err := url.PathUnescape(r.URL.EscapedPath())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, docType, ok := strings.Cut(path, "/services/busdox-docid-qns::"); ok {
+			expires := "2099-01-01T00:00:00Z"
+			for _, name := range expired {
+				if ParseDocumentType(docType).LocalName == name {
+					expires = "2021-01-01T00:00:00Z"
+				}
+			}
+			metadata := strings.Replace(testServiceMetadata, "DOC", docType, 1)
+			fmt.Fprint(w, strings.Replace(metadata, "EXPIRES", expires, 1))
+			return
+		}
+		if strings.HasSuffix(path, "/iso6523-actorid-upis::0192:921605900") {
+			fmt.Fprint(w, strings.ReplaceAll(testServiceGroup, "HOST", srv.URL))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestClient returns a client that finds 0192:921605900 on smp without
+// querying DNS, and makes no requests beyond the SMP
+func newTestClient(smp *httptest.Server) *Client {
+	c := NewClient()
+	c.DirectoryURL = ""
+	c.CheckProductionSML = false
+	c.Cache.Set("sml:"+c.participantHostname("0192", "921605900"), strings.TrimPrefix(smp.URL, "http://"), time.Hour)
+	return c
+}
+
+func TestActiveOnly(t *testing.T) {
+	smp := newTestSMP(t, "Invoice")
+	ctx := context.Background()
+
+	for _, activeOnly := range []bool{false, true} {
+		c := newTestClient(smp)
+		c.ActiveOnly = activeOnly
+
+		result, err := c.Lookup(ctx, "0192", "921605900")
+		if err != nil {
+			t.Fatalf("ActiveOnly=%t: Lookup: %v", activeOnly, err)
+		}
+		hasInvoice := false
+		for _, docType := range result.DocumentTypes {
+			hasInvoice = hasInvoice || docType == BISBillingInvoice
+		}
+		if hasInvoice == activeOnly {
+			t.Errorf("ActiveOnly=%t: Lookup document types = %v", activeOnly, result.DocumentTypes)
+		}
+		if got := len(result.DocumentTypes); activeOnly && got != 1 {
+			t.Errorf("ActiveOnly=%t: Lookup lists %d document types, want 1", activeOnly, got)
+		}
+		for _, capability := range result.Capabilities {
+			if activeOnly && capability == capabilityBISBillingInvoice {
+				t.Errorf("ActiveOnly=%t: Lookup capabilities = %v", activeOnly, result.Capabilities)
+			}
+		}
+
+		for _, docType := range []string{BISBillingInvoice, BISBillingInvoiceID} {
+			supported, endpoint, err := c.SupportsDocumentType(ctx, "0192", "921605900", docType)
+			if err != nil {
+				t.Fatalf("ActiveOnly=%t: SupportsDocumentType(%s): %v", activeOnly, docType, err)
+			}
+			if supported == activeOnly || (endpoint == nil) == !activeOnly {
+				t.Errorf("ActiveOnly=%t: SupportsDocumentType(%s) = %t, %v", activeOnly, docType, supported, endpoint)
+			}
+		}
+
+		all, support, err := c.SupportsDocumentTypes(ctx, "0192", "921605900",
+			[]string{BISBillingInvoiceID, BISBillingCreditNoteID}, SupportsEach)
+		if err != nil {
+			t.Fatalf("ActiveOnly=%t: SupportsDocumentTypes: %v", activeOnly, err)
+		}
+		if all == activeOnly || support[0].Supported == activeOnly || !support[1].Supported {
+			t.Errorf("ActiveOnly=%t: SupportsDocumentTypes = %t, %+v", activeOnly, all, support)
+		}
+
+		endpoints, err := c.GetBillingEndpoints(ctx, "0192", "921605900")
+		if err != nil {
+			t.Fatalf("ActiveOnly=%t: GetBillingEndpoints: %v", activeOnly, err)
+		}
+		if (endpoints.Invoice == nil) != activeOnly || endpoints.CreditNote == nil {
+			t.Errorf("ActiveOnly=%t: GetBillingEndpoints = %+v", activeOnly, endpoints)
+		}
+
+		capabilities, err := c.FullCapabilities(ctx, "0192", "921605900")
+		if err != nil {
+			t.Fatalf("ActiveOnly=%t: FullCapabilities: %v", activeOnly, err)
+		}
+		if want := map[bool]int{false: 2, true: 1}[activeOnly]; len(capabilities.Services) != want {
+			t.Errorf("ActiveOnly=%t: FullCapabilities has %d services, want %d", activeOnly, len(capabilities.Services), want)
+		}
+	}
+}
+
+func TestServiceGroupPathEscaping(t *testing.T) {
+	tests := []struct {
+		icd, identifier string
+		want            string
+	}{
+		{"0192", "921605900", "/iso6523-actorid-upis%3A%3A0192%3A921605900"},
+		{"0088", "AB C/1", "/iso6523-actorid-upis%3A%3A0088%3Aab%20c%2F1"},
+		{"9915", "test+1", "/iso6523-actorid-upis%3A%3A9915%3Atest+1"},
+	}
+	for _, tt := range tests {
+		var requests []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.RequestURI)
+			http.NotFound(w, r)
+		}))
+		NewClient().DocumentTypesViaSMP(context.Background(), srv.URL, tt.icd, tt.identifier)
+		srv.Close()
+		if len(requests) == 0 || requests[0] != tt.want {
+			t.Errorf("%s:%s: requested %q, want %q first", tt.icd, tt.identifier, requests, tt.want)
+		}
+	}
+}
+
+func TestParticipantHostnames(t *testing.T) {
+	tests := []struct {
+		icd, identifier string
+		cname, naptr    string
+	}{
+		{"0192", "921605900",
+			"b-e258de9dbe1f34f17b55d5d3cc5e7a66.iso6523-actorid-upis.edelivery.tech.ec.europa.eu",
+			"edomqmynkzsm3hvpe24uyqzskf6uuuqbqrlvskch7vw2bgtsjwnq.iso6523-actorid-upis.edelivery.tech.ec.europa.eu"},
+		{"0192", "810305792",
+			"b-184a2eaf0fc961265ddbdfba1d30a989.iso6523-actorid-upis.edelivery.tech.ec.europa.eu",
+			"wwiehbtxydisojptypssf3mimwn4rdi4etwzmqycrtfvskxtrwpa.iso6523-actorid-upis.edelivery.tech.ec.europa.eu"},
+		{"0088", "5798000000001",
+			"b-4c7e158a31c6dfa533dcfaf4b80fb205.iso6523-actorid-upis.edelivery.tech.ec.europa.eu",
+			"reana6asz6h7dlkfrw4fbjgue7z74gx3uta2oik2p6tawtasctoq.iso6523-actorid-upis.edelivery.tech.ec.europa.eu"},
+	}
+	for _, tt := range tests {
+		if got := SMLHostname(tt.icd, tt.identifier, participantScheme, smlDomain); got != tt.cname {
+			t.Errorf("SMLHostname(%s:%s) = %s, want %s", tt.icd, tt.identifier, got, tt.cname)
+		}
+		if got := NAPTRHostname(tt.icd, tt.identifier, participantScheme, smlDomain); got != tt.naptr {
+			t.Errorf("NAPTRHostname(%s:%s) = %s, want %s", tt.icd, tt.identifier, got, tt.naptr)
+		}
+	}
+}
+
+func TestSMLHostnameNormalization(t *testing.T) {
+	tests := []struct {
+		icd, identifier string
+		want            string
+	}{
+		{"0192", "921605900", "b-e258de9dbe1f34f17b55d5d3cc5e7a66"},
+		{" 0192", "921605900 ", "b-e258de9dbe1f34f17b55d5d3cc5e7a66"},
+		{"\t0192\n", " 921605900", "b-e258de9dbe1f34f17b55d5d3cc5e7a66"},
+		{"0192", "abc", "b-f2fe58b55b28f990dae36127d6f4b14c"},
+		{"0192", "ABC", "b-f2fe58b55b28f990dae36127d6f4b14c"},
+		{"0192", " AbC ", "b-f2fe58b55b28f990dae36127d6f4b14c"},
+		{"9908", "921605900", "b-34ca1048701cb9aa035989a0b022761e"},
+	}
+	for _, tt := range tests {
+		want := tt.want + ".iso6523-actorid-upis.edelivery.tech.ec.europa.eu"
+		if got := SMLHostname(tt.icd, tt.identifier, participantScheme, smlDomain); got != want {
+			t.Errorf("SMLHostname(%q, %q) = %s, want %s", tt.icd, tt.identifier, got, want)
+		}
+	}
+}
+
+func TestHostnamePrefix(t *testing.T) {
+	const hash = "e258de9dbe1f34f17b55d5d3cc5e7a66"
+	const suffix = ".iso6523-actorid-upis.edelivery.tech.ec.europa.eu"
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "b-" + hash + suffix},
+		{"b-", "b-" + hash + suffix},
+		{"test-", "test-" + hash + suffix},
+		{"X-", "x-" + hash + suffix},
+	}
+	for _, tt := range tests {
+		c := NewClient()
+		c.HostnamePrefix = tt.prefix
+		if got := c.DNSName("0192", "921605900"); got != tt.want {
+			t.Errorf("HostnamePrefix %q: DNSName = %s, want %s", tt.prefix, got, tt.want)
+		}
+	}
+
+	// Lookup queries the prefixed name: only it is in the cache
+	smp := newTestSMP(t)
+	c := NewClient()
+	c.DirectoryURL = ""
+	c.CheckProductionSML = false
+	c.DNSServer = "127.0.0.1:1"
+	c.HostnamePrefix = "test-"
+	c.Cache.Set("sml:test-"+hash+suffix, strings.TrimPrefix(smp.URL, "http://"), time.Hour)
+	if _, err := c.Lookup(context.Background(), "0192", "921605900"); err != nil {
+		t.Errorf("Lookup with HostnamePrefix: %v", err)
+	}
+
+	// An environment file's hostname_prefix reaches the client
+	path := filepath.Join(t.TempDir(), "environments.json")
+	config := `{"environments": [{"name": "custom", "sml_domain": "sml.example", "scheme": "iso6523-actorid-upis", "hostname_prefix": "test-"}]}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	environments, err := LoadEnvironments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = NewClient()
+	if err := environments["custom"].Apply(c); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.DNSName("0192", "921605900"), "test-"+hash+".iso6523-actorid-upis.sml.example"; got != want {
+		t.Errorf("environment DNSName = %s, want %s", got, want)
+	}
+}
+
+func TestFetchServiceGroupOnce(t *testing.T) {
+	const emptyServiceGroup = `<?xml version="1.0" encoding="UTF-8"?>
+<ServiceGroup xmlns="http://busdox.org/serviceMetadata/publishing/1.0/" xmlns:id="http://busdox.org/transport/identifiers/1.0/">
+  <id:ParticipantIdentifier scheme="iso6523-actorid-upis">0192:921605900</id:ParticipantIdentifier>
+  <ServiceMetadataReferenceCollection/>
+</ServiceGroup>`
+	relativeServiceGroup := strings.ReplaceAll(testServiceGroup, "HOST/", "")
+
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantHrefs int
+		wantErr   error // nil for success, ErrNoDocuments, or errAny
+	}{
+		{"two references", http.StatusOK, testServiceGroup, 2, nil},
+		{"relative hrefs", http.StatusOK, relativeServiceGroup, 2, nil},
+		{"empty ServiceGroup", http.StatusOK, emptyServiceGroup, 0, ErrNoDocuments},
+		{"not found", http.StatusNotFound, "", 0, ErrNoDocuments},
+		{"wrong root element", http.StatusOK, `<SignedServiceMetadata xmlns="http://busdox.org/serviceMetadata/publishing/1.0/"/>`, 0, errAny},
+		{"malformed XML", http.StatusOK, `<ServiceGroup`, 0, errAny},
+		{"server error", http.StatusInternalServerError, "", 0, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/xml")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, strings.ReplaceAll(tt.body, "HOST", srv.URL))
+			}))
+			defer srv.Close()
+
+			hrefs, version, err := NewClient().fetchServiceGroupOnce(context.Background(), srv.URL, "0192", "921605900")
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("error: %v", err)
+			case tt.wantErr == errAny && (err == nil || errors.Is(err, ErrNoDocuments)):
+				t.Fatalf("error = %v, want a failure", err)
+			case tt.wantErr == ErrNoDocuments && !errors.Is(err, ErrNoDocuments):
+				t.Fatalf("error = %v, want ErrNoDocuments", err)
+			}
+			if len(hrefs) != tt.wantHrefs {
+				t.Errorf("got %d hrefs, want %d: %v", len(hrefs), tt.wantHrefs, hrefs)
+			}
+			for _, href := range hrefs {
+				if !strings.HasPrefix(href, srv.URL+"/iso6523-actorid-upis%3A%3A0192%3A921605900/services/") {
+					t.Errorf("href %s is not an absolute ServiceMetadata URL on the SMP", href)
+				}
+			}
+			if tt.status == http.StatusOK && tt.wantErr != errAny && version != "1.0" {
+				t.Errorf("version = %q, want 1.0", version)
+			}
+		})
+	}
+}
+
+// errAny stands for any error other than ErrNoDocuments in test tables
+var errAny = errors.New("any error")
+
+func TestDecodeBodyGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(testServiceGroup))
+	gz.Close()
+
+	tests := []struct {
+		encoding        string
+		maxResponseSize int64
+		wantErr         bool
+	}{
+		{"gzip", 0, false},
+		{"x-gzip", 0, false},
+		{"GZIP", 0, false},
+		// The limit applies to the decoded size, not the compressed one
+		{"gzip", int64(len(testServiceGroup)), false},
+		{"gzip", int64(len(testServiceGroup)) - 1, true},
+	}
+	for _, tt := range tests {
+		var acceptEncoding string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("Accept-Encoding")
+			w.Header().Set("Content-Encoding", tt.encoding)
+			w.Write(compressed.Bytes())
+		}))
+		c := NewClient()
+		c.MaxResponseSize = tt.maxResponseSize
+		body, _, err := c.getContent(context.Background(), srv.URL, "text/xml")
+		srv.Close()
+
+		if !strings.Contains(acceptEncoding, "gzip") {
+			t.Errorf("Accept-Encoding = %q, want gzip", acceptEncoding)
+		}
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("%s, limit %d: got %d bytes, want an error", tt.encoding, tt.maxResponseSize, len(body))
+		case !tt.wantErr && err != nil:
+			t.Errorf("%s, limit %d: %v", tt.encoding, tt.maxResponseSize, err)
+		case !tt.wantErr && string(body) != testServiceGroup:
+			t.Errorf("%s, limit %d: body = %q", tt.encoding, tt.maxResponseSize, body)
+		}
+	}
+}
+
+// contentLengthRecorder records the Content-Length of the last response it
+// fetched
+type contentLengthRecorder struct {
+	contentLength int64
+}
+
+func (r *contentLengthRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		r.contentLength = resp.ContentLength
+	}
+	return resp, err
+}
+
+func TestDecodeBodyChunked(t *testing.T) {
+	tests := []struct {
+		maxResponseSize int64
+		wantErr         bool
+	}{
+		{0, false},
+		{int64(len(testServiceGroup)), false},
+		{int64(len(testServiceGroup)) - 1, true},
+	}
+	for _, tt := range tests {
+		rec := &contentLengthRecorder{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Flushing before the end makes the server send it chunked
+			half := len(testServiceGroup) / 2
+			w.Write([]byte(testServiceGroup[:half]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(testServiceGroup[half:]))
+		}))
+		c := NewClient()
+		c.MaxResponseSize = tt.maxResponseSize
+		c.HTTPClient = &http.Client{Transport: rec}
+		body, _, err := c.getContent(context.Background(), srv.URL, "text/xml")
+		srv.Close()
+
+		if rec.contentLength != -1 {
+			t.Errorf("limit %d: Content-Length = %d, want a chunked response", tt.maxResponseSize, rec.contentLength)
+		}
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("limit %d: got %d bytes, want an error", tt.maxResponseSize, len(body))
+		case !tt.wantErr && err != nil:
+			t.Errorf("limit %d: %v", tt.maxResponseSize, err)
+		case !tt.wantErr && string(body) != testServiceGroup:
+			t.Errorf("limit %d: body = %q", tt.maxResponseSize, body)
+		}
+	}
+
+	// A chunked response cut off before its last chunk is an error, not a
+	// short body
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/xml\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n", 10, testServiceGroup[:10])
+		buf.Flush()
+	}))
+	defer srv.Close()
+	c := NewClient()
+	_, _, err := c.getContent(context.Background(), srv.URL, "text/xml")
+	if err == nil || !strings.Contains(err.Error(), "chunked") {
+		t.Errorf("truncated chunked response: err = %v, want a chunked response error", err)
+	}
+}
+
+func TestParseParticipantIDNorwegian(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{"0192:921605900", false},
+		{"0192:921605901", true},
+		{"0192:92160590", true},
+		{"0192:NO921605900MVA", false},
+		{"0192:no921605900mva", false},
+		{"0192:NO921605901MVA", true},
+		{"0192:NOMVA", true},
+		{"9908:921605900", false},
+		{"9908:123456789", false},
+		{"9908:NO921605900MVA", false},
+	}
+	for _, tt := range tests {
+		p, err := ParseParticipantID(tt.id)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseParticipantID(%q) error = %v, want error %t", tt.id, err, tt.wantErr)
+		}
+		if err == nil && p.String() != tt.id {
+			t.Errorf("ParseParticipantID(%q) = %s", tt.id, p)
+		}
+	}
+}
+
+func TestASCIIHostname(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example", "xn--bcher-kva.example"},
+		{"bücher.example:8080", "xn--bcher-kva.example:8080"},
+		{"smp.example.com", "smp.example.com"},
+		{"127.0.0.1:8080", "127.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		if got := asciiHostname(tt.host); got != tt.want {
+			t.Errorf("asciiHostname(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+// newTestDNS starts a nameserver on UDP and TCP that answers with handler,
+// and returns its address
+func newTestDNS(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		go srv.ActivateAndServe()
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+func TestResolveNAPTR(t *testing.T) {
+	c := NewClient()
+	naptrName := dns.Fqdn(NAPTRHostname("0192", "921605900", participantScheme, smlDomain))
+	c.DNSServer = newTestDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name != naptrName || r.Question[0].Qtype != dns.TypeNAPTR {
+			m.Rcode = dns.RcodeNameError
+			w.WriteMsg(m)
+			return
+		}
+		for _, rr := range []string{
+			naptrName + ` 60 IN NAPTR 100 20 "U" "Meta:SMP" "!^.*$!https://backup.example.com!" .`,
+			naptrName + ` 60 IN NAPTR 100 10 "U" "Meta:SMP" "!^.*$!https://smp.example.com!" .`,
+			naptrName + ` 60 IN NAPTR 10 10 "U" "Meta:Other" "!^.*$!https://other.example.com!" .`,
+		} {
+			record, err := dns.NewRR(rr)
+			if err != nil {
+				t.Error(err)
+			}
+			m.Answer = append(m.Answer, record)
+		}
+		w.WriteMsg(m)
+	})
+
+	smpURL, err := c.ResolveNAPTR(context.Background(), "0192", "921605900")
+	if err != nil || smpURL != "https://smp.example.com" {
+		t.Errorf("ResolveNAPTR = %q, %v, want https://smp.example.com", smpURL, err)
+	}
+	_, err = c.ResolveNAPTR(context.Background(), "0192", "810305792")
+	if !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("ResolveNAPTR of an unknown participant: %v, want ErrNotRegistered", err)
+	}
+}
+
+func TestReportFetchesServiceGroupOnce(t *testing.T) {
+	smp := newTestSMP(t)
+	serviceGroupRequests := 0
+	handler := smp.Config.Handler
+	smp.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() == "/iso6523-actorid-upis%3A%3A0192%3A921605900" {
+			serviceGroupRequests++
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	report, err := newTestClient(smp).Report(context.Background(), ParticipantID{ICD: "0192", Identifier: "921605900"})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if !report.Registered || !report.Invoice || !report.CreditNote || len(report.TransportProfiles) != 1 {
+		t.Errorf("Report = %+v", report)
+	}
+	if serviceGroupRequests != 1 {
+		t.Errorf("Report fetched the ServiceGroup %d times, want 1", serviceGroupRequests)
+	}
+}
+
+// testServiceGroup2 is testServiceGroup as an OASIS SMP 2.0 ServiceGroup
+const testServiceGroup2 = `<?xml version="1.0" encoding="UTF-8"?>
+<ServiceGroup xmlns="http://docs.oasis-open.org/bdxr/ns/SMP/2/ServiceGroup" xmlns:cbc="http://docs.oasis-open.org/bdxr/ns/SMP/2/CommonBasicComponents" xmlns:cac="http://docs.oasis-open.org/bdxr/ns/SMP/2/CommonAggregateComponents">
+  <cbc:SMPVersionID>2.0</cbc:SMPVersionID>
+  <cbc:ParticipantID schemeID="iso6523-actorid-upis">0192:921605900</cbc:ParticipantID>
+  <cac:ServiceReference>
+    <cbc:ID schemeID="busdox-docid-qns">urn:oasis:names:specification:ubl:schema:xsd:Invoice-2::Invoice##urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0::2.1</cbc:ID>
+  </cac:ServiceReference>
+  <cac:ServiceReference>
+    <cbc:ID schemeID="busdox-docid-qns">urn:oasis:names:specification:ubl:schema:xsd:CreditNote-2::CreditNote##urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0::2.1</cbc:ID>
+  </cac:ServiceReference>
+</ServiceGroup>`
+
+func TestSMPVersionDetection(t *testing.T) {
+	tests := []struct {
+		body, contentType string
+		wantVersion       string
+	}{
+		{testServiceGroup, "application/xml", "1.0"},
+		{testServiceGroup, "text/xml; charset=UTF-8", "1.0"},
+		{testServiceGroup2, "application/xml", "2.0"},
+		{testServiceGroup2, "text/xml; charset=UTF-8", "2.0"},
+	}
+	for _, tt := range tests {
+		var accept string
+		var srv *httptest.Server
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accept = r.Header.Get("Accept")
+			w.Header().Set("Content-Type", tt.contentType)
+			fmt.Fprint(w, strings.ReplaceAll(tt.body, "HOST", srv.URL))
+		}))
+		hrefs, version, err := NewClient().fetchServiceGroupOnce(context.Background(), srv.URL, "0192", "921605900")
+		srv.Close()
+
+		if err != nil {
+			t.Errorf("SMP %s as %s: %v", tt.wantVersion, tt.contentType, err)
+			continue
+		}
+		if version != tt.wantVersion {
+			t.Errorf("SMP %s as %s: detected version %s", tt.wantVersion, tt.contentType, version)
+		}
+		if !strings.Contains(accept, "application/xml") {
+			t.Errorf("SMP %s as %s: Accept = %q", tt.wantVersion, tt.contentType, accept)
+		}
+		want := srv.URL + "/iso6523-actorid-upis%3A%3A0192%3A921605900/services/busdox-docid-qns%3A%3Aurn%3Aoasis%3Anames%3Aspecification%3Aubl%3Aschema%3Axsd%3AInvoice-2%3A%3AInvoice%23%23urn%3Acen.eu%3Aen16931%3A2017%23compliant%23urn%3Afdc%3Apeppol.eu%3A2017%3Apoacc%3Abilling%3A3.0%3A%3A2.1"
+		if len(hrefs) != 2 || hrefs[0] != want {
+			t.Errorf("SMP %s as %s: hrefs = %v, want %s first", tt.wantVersion, tt.contentType, hrefs, want)
+		}
+	}
+}
+
+func TestParseParticipantIDSchemes(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    ParticipantID
+		wantErr bool
+	}{
+		{"0088:5798000000001", ParticipantID{"0088", "5798000000001"}, false},
+		{"iso6523-actorid-upis::0088:5798000000001", ParticipantID{"0088", "5798000000001"}, false},
+		{" 0208:0123456789 ", ParticipantID{"0208", "0123456789"}, false},
+		// Not in the scheme list, but well-formed
+		{"9999:abc", ParticipantID{"9999", "abc"}, false},
+		{"AB:123", ParticipantID{"AB", "123"}, false},
+		{"ABCDEFGHIJ:123", ParticipantID{"ABCDEFGHIJ", "123"}, false},
+		{"x1:123", ParticipantID{"x1", "123"}, false},
+		// Too short or too long
+		{"1:123", ParticipantID{}, true},
+		{"ABCDEFGHIJK:123", ParticipantID{}, true},
+		// Bad characters
+		{"01-2:123", ParticipantID{}, true},
+		{"01 2:123", ParticipantID{}, true},
+		{"0ø88:123", ParticipantID{}, true},
+		// Missing parts
+		{":123", ParticipantID{}, true},
+		{"0088:", ParticipantID{}, true},
+		{"0088", ParticipantID{}, true},
+		{"", ParticipantID{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseParticipantID(tt.id)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseParticipantID(%q) error = %v, want error %t", tt.id, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseParticipantID(%q) = %+v, want %+v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestJSONSMP(t *testing.T) {
+	const serviceGroup = `{
+  "participantID": "iso6523-actorid-upis::0192:921605900",
+  "urls": [{
+    "href": "HOST/iso6523-actorid-upis%3A%3A0192%3A921605900/services/busdox-docid-qns%3A%3Aurn%3Aoasis%3Anames%3Aspecification%3Aubl%3Aschema%3Axsd%3AInvoice-2%3A%3AInvoice%23%23urn%3Acen.eu%3Aen16931%3A2017%23compliant%23urn%3Afdc%3Apeppol.eu%3A2017%3Apoacc%3Abilling%3A3.0%3A%3A2.1",
+    "documentTypeID": "busdox-docid-qns::urn:oasis:names:specification:ubl:schema:xsd:Invoice-2::Invoice##urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0::2.1"
+  }]
+}`
+	const serviceMetadata = `{
+  "documentTypeID": "busdox-docid-qns::urn:oasis:names:specification:ubl:schema:xsd:Invoice-2::Invoice##urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0::2.1",
+  "processes": [{
+    "processID": "cenbii-procid-ubl::urn:fdc:peppol.eu:2017:poacc:billing:01:1.0",
+    "endpoints": [{
+      "transportProfile": "peppol-transport-as4-v2_0",
+      "endpointReference": "https://ap.example.com/as4",
+      "serviceActivationDate": "2020-01-01T00:00:00Z",
+      "serviceExpirationDate": "2099-01-01T00:00:00Z",
+      "serviceDescription": "Example AP",
+      "technicalContactUrl": "https://example.com/contact"
+    }]
+  }]
+}`
+	var accepts []string
+	var smp *httptest.Server
+	smp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepts = append(accepts, r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.EscapedPath(), "/services/") {
+			fmt.Fprint(w, serviceMetadata)
+			return
+		}
+		fmt.Fprint(w, strings.ReplaceAll(serviceGroup, "HOST", smp.URL))
+	}))
+	defer smp.Close()
+
+	c := newTestClient(smp)
+	c.PreferJSON = true
+	capabilities, err := c.FullCapabilities(context.Background(), "0192", "921605900")
+	if err != nil {
+		t.Fatalf("FullCapabilities: %v", err)
+	}
+	for _, accept := range accepts {
+		if !strings.HasPrefix(accept, "application/json") {
+			t.Errorf("Accept = %q, want JSON first", accept)
+		}
+	}
+	if len(capabilities.Services) != 1 {
+		t.Fatalf("got %d services, want 1", len(capabilities.Services))
+	}
+	service := capabilities.Services[0]
+	if service.DocumentType != BISBillingInvoiceID {
+		t.Errorf("DocumentType = %s", service.DocumentType)
+	}
+	if len(service.Processes) != 1 || service.Processes[0].ID != "urn:fdc:peppol.eu:2017:poacc:billing:01:1.0" ||
+		len(service.Processes[0].Endpoints) != 1 {
+		t.Fatalf("Processes = %+v", service.Processes)
+	}
+	endpoint := service.Processes[0].Endpoints[0]
+	if endpoint.TransportProfile != TransportProfileAS4 || endpoint.Address != "https://ap.example.com/as4" ||
+		endpoint.URL == nil || endpoint.ExpirationDate.Year() != 2099 || endpoint.ServiceDescription != "Example AP" {
+		t.Errorf("Endpoint = %+v", endpoint)
+	}
+}
+
+// recordingCache is a Cache that records the keys it's asked for
+type recordingCache struct {
+	Cache
+	gets, sets []string
+}
+
+func (c *recordingCache) Get(key string) (string, bool) {
+	c.gets = append(c.gets, key)
+	return c.Cache.Get(key)
+}
+
+func (c *recordingCache) Set(key, value string, ttl time.Duration) {
+	c.sets = append(c.sets, key)
+	c.Cache.Set(key, value, ttl)
+}
+
+func TestCacheKeysNormalized(t *testing.T) {
+	cache := &recordingCache{Cache: NewMemoryCache()}
+	c := NewClient()
+	c.Cache = cache
+	c.SMLOnly = true
+	c.CheckProductionSML = false
+	hostname := c.participantHostname("0192", "x")
+	cache.Cache.Set("sml:"+hostname, "smp.example.com", time.Hour)
+
+	var keys [][]string
+	for _, id := range []string{"0192:X", "0192:x", " 0192:X "} {
+		icd, identifier, _ := strings.Cut(id, ":")
+		cache.gets, cache.sets = nil, nil
+		if _, err := c.Lookup(context.Background(), icd, identifier); err != nil {
+			t.Fatalf("Lookup(%q): %v", id, err)
+		}
+		keys = append(keys, append(cache.gets, cache.sets...))
+	}
+
+	want := []string{"sml:" + hostname}
+	for i, id := range []string{"0192:X", "0192:x", " 0192:X "} {
+		if fmt.Sprint(keys[i]) != fmt.Sprint(want) {
+			t.Errorf("lookup of %q used cache keys %q, want %q", id, keys[i], want)
+		}
+	}
+}
+
+func TestRegistrationByEnvironmentKeepsSettings(t *testing.T) {
+	c := NewClient()
+	before := *c
+	c.Cache.Set("sml:x-e258de9dbe1f34f17b55d5d3cc5e7a66.custom-scheme.sml.example", "smp.example.com", time.Hour)
+	envs := map[string]Environment{
+		"custom": {Name: "custom", SMLDomain: "sml.example", Scheme: "custom-scheme", HostnamePrefix: "x-"},
+	}
+	registered, err := c.RegistrationByEnvironment(context.Background(), ParticipantID{ICD: "0192", Identifier: "921605900"}, envs)
+	if err != nil || !registered["custom"] {
+		t.Errorf("RegistrationByEnvironment = %v, %v, want custom registered from the cache", registered, err)
+	}
+	if c.SMLDomain != before.SMLDomain || c.ParticipantScheme != before.ParticipantScheme || c.HostnamePrefix != before.HostnamePrefix {
+		t.Errorf("RegistrationByEnvironment changed the client: %q %q %q", c.SMLDomain, c.ParticipantScheme, c.HostnamePrefix)
+	}
+}
+
+func TestSMPServiceURL(t *testing.T) {
+	const invoicePath = "/iso6523-actorid-upis%3A%3A0192%3A921605900/services/busdox-docid-qns%3A%3Aurn%3Aoasis%3Anames%3Aspecification%3Aubl%3Aschema%3Axsd%3AInvoice-2%3A%3AInvoice%23%23urn%3Acen.eu%3Aen16931%3A2017%23compliant%23urn%3Afdc%3Apeppol.eu%3A2017%3Apoacc%3Abilling%3A3.0%3A%3A2.1"
+	tests := []struct {
+		base, docTypeID string
+		want            string // empty if an error is expected
+	}{
+		{"http://smp.example.com", BISBillingInvoiceID, "http://smp.example.com" + invoicePath},
+		{"http://smp.example.com", "busdox-docid-qns::" + BISBillingInvoiceID, "http://smp.example.com" + invoicePath},
+		{"https://smp.example.com/smp/", BISBillingInvoiceID, "https://smp.example.com/smp" + invoicePath},
+		{"http://smp.example.com", "urn:x::Doc##a/b?c d#e::1",
+			"http://smp.example.com/iso6523-actorid-upis%3A%3A0192%3A921605900/services/busdox-docid-qns%3A%3Aurn%3Ax%3A%3ADoc%23%23a%2Fb%3Fc%20d%23e%3A%3A1"},
+		{"http://smp.example.com", " ", ""},
+		{"http://smp.example.com?x=1", BISBillingInvoiceID, ""},
+		{"ftp://smp.example.com", BISBillingInvoiceID, ""},
+	}
+	for _, tt := range tests {
+		got, err := SMPServiceURL(tt.base, "0192", "921605900", tt.docTypeID)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("SMPServiceURL(%q, %q) = %s, want an error", tt.base, tt.docTypeID, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("SMPServiceURL(%q, %q) = %s, %v, want %s", tt.base, tt.docTypeID, got, err, tt.want)
+			continue
+		}
+		// The document identifier must survive as one path segment
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Errorf("SMPServiceURL(%q, %q) = %s: %v", tt.base, tt.docTypeID, got, err)
+			continue
+		}
+		segments := strings.Split(u.EscapedPath(), "/")
+		docType, _ := url.PathUnescape(segments[len(segments)-1])
+		if u.RawQuery != "" || u.Fragment != "" || docType != "busdox-docid-qns::"+strings.TrimPrefix(tt.docTypeID, "busdox-docid-qns::") {
+			t.Errorf("SMPServiceURL(%q, %q) = %s: last segment %q, query %q, fragment %q", tt.base, tt.docTypeID, got, docType, u.RawQuery, u.Fragment)
+		}
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	tests := []struct {
+		name             string
+		rcode            int
+		negativeCacheTTL time.Duration
+		wantCached       bool
+	}{
+		{"NXDOMAIN", dns.RcodeNameError, 5 * time.Minute, true},
+		{"NXDOMAIN without NegativeCacheTTL", dns.RcodeNameError, 0, false},
+		{"SERVFAIL", dns.RcodeServerFailure, 5 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		var queries atomic.Int32
+		c := NewClient()
+		c.DirectoryURL = ""
+		c.CheckProductionSML = false
+		c.NegativeCacheTTL = tt.negativeCacheTTL
+		// RequireDNSSEC sends the SML queries to DNSServer instead of the
+		// system resolver
+		c.RequireDNSSEC = true
+		c.DNSServer = newTestDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			queries.Add(1)
+			m := new(dns.Msg)
+			m.SetRcode(r, tt.rcode)
+			m.AuthenticatedData = true
+			w.WriteMsg(m)
+		})
+
+		ctx := context.Background()
+		_, err := c.Lookup(ctx, "0192", "921605900")
+		if got := errors.Is(err, ErrNotRegistered); got != (tt.rcode == dns.RcodeNameError) {
+			t.Fatalf("%s: first Lookup: %v", tt.name, err)
+		}
+		before := queries.Load()
+		_, err = c.Lookup(ctx, "0192", "921605900")
+		if got := errors.Is(err, ErrNotRegistered); got != (tt.rcode == dns.RcodeNameError) {
+			t.Errorf("%s: second Lookup: %v", tt.name, err)
+		}
+		if cached := queries.Load() == before; cached != tt.wantCached {
+			t.Errorf("%s: second Lookup served from the cache = %t, want %t", tt.name, cached, tt.wantCached)
+		}
+	}
+}
+
+func TestWatchStateKeysByProcess(t *testing.T) {
+	capabilities := func(secondAddress string) *FullCapabilities {
+		return &FullCapabilities{Services: []ServiceMetadata{{
+			DocumentType: BISBillingInvoiceID,
+			Processes: []Process{
+				{ID: "urn:process:a", Endpoints: []Endpoint{{TransportProfile: "peppol-transport-as4-v2_0", Address: "https://ap.example.com/a"}}},
+				{ID: "urn:process:b", Endpoints: []Endpoint{{TransportProfile: "peppol-transport-as4-v2_0", Address: secondAddress}}},
+			},
+		}}}
+	}
+	old := newWatchState(capabilities("https://ap.example.com/b"))
+	if got := len(old[BISBillingInvoiceID]); got != 2 {
+		t.Fatalf("watch state has %d endpoints, want one per process", got)
+	}
+
+	events := diffWatchStates(old, newWatchState(capabilities("https://ap.example.com/moved")))
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want the second process's endpoint removed and added: %+v", len(events), events)
+	}
+	for _, event := range events {
+		if event.Process != "urn:process:b" {
+			t.Errorf("event %s for process %q, want urn:process:b", event.Type, event.Process)
+		}
+	}
+}
+
+func TestTLSVersionError(t *testing.T) {
+	smp := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	smp.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	smp.Config.ErrorLog = log.New(io.Discard, "", 0)
+	smp.StartTLS()
+	defer smp.Close()
+
+	c := NewClient()
+	c.InsecureSkipVerify = true
+	c.MinTLSVersion = tls.VersionTLS13
+	_, _, err := c.getContent(context.Background(), smp.URL, "text/xml")
+	if err == nil || !strings.Contains(err.Error(), "does not support TLS 1.3") {
+		t.Errorf("err = %v, want the server's missing TLS 1.3 support reported", err)
+	}
+	if isTLSVersionError(errors.New("protocol version not supported")) {
+		t.Error("a plain error mentioning the protocol version matched")
+	}
+}
@@ -0,0 +1,270 @@
+package peppollookup
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snapbooks-app/peppol-lookup/go/internal/parallel"
+)
+
+// CapabilityReport is a display-ready summary of a participant, e.g. for an
+// onboarding UI. Its fields are stable; slices are empty rather than null.
+type CapabilityReport struct {
+	ParticipantID    string   `json:"participant_id"`
+	Registered       bool     `json:"registered"`
+	Name             string   `json:"name"`
+	Country          string   `json:"country"`
+	Documents        []string `json:"documents"`         // friendly names of the published document types, e.g. "Credit Note"
+	Capabilities     []string `json:"capabilities"`      // matched specifications, e.g. "BIS Billing 3.0 Invoice"
+	NationalProfiles []string `json:"national_profiles"` // national profiles, e.g. "EHF Invoice 2.0"
+	Invoice          bool     `json:"invoice"`           // supports BIS Billing 3.0 invoices
+	CreditNote       bool     `json:"credit_note"`       // supports BIS Billing 3.0 credit notes
+
+	// TransportProfiles is the distinct set of transport profiles across
+	// all endpoints, e.g. ["peppol-transport-as4-v2_0"]
+	TransportProfiles []string `json:"transport_profiles"`
+
+	// DocumentTypes and Endpoints hold the full document identifiers and
+	// every endpoint, for comparing reports with Delta
+	DocumentTypes []string         `json:"document_types"`
+	Endpoints     []ReportEndpoint `json:"endpoints"`
+
+	Warnings    []string  `json:"warnings"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// ReportEndpoint is an endpoint in a CapabilityReport
+type ReportEndpoint struct {
+	DocumentType     string           `json:"document_type"`
+	Process          string           `json:"process"`
+	TransportProfile TransportProfile `json:"transport_profile"`
+	Address          string           `json:"address"`
+
+	// CertificateFingerprint is the SHA-256 of the endpoint certificate,
+	// or of its text if it doesn't parse
+	CertificateFingerprint string `json:"certificate_fingerprint"`
+}
+
+// Report summarizes a participant's registration, business card,
+// supported documents and transport profiles for display, from one
+// FullCapabilities fetch and their business card. A participant who isn't
+// registered, or publishes no document types, is reported rather than
+// returned as an error.
+func (c *Client) Report(ctx context.Context, id ParticipantID) (CapabilityReport, error) {
+	report := CapabilityReport{
+		ParticipantID:     id.String(),
+		Documents:         []string{},
+		Capabilities:      []string{},
+		NationalProfiles:  []string{},
+		TransportProfiles: []string{},
+		DocumentTypes:     []string{},
+		Endpoints:         []ReportEndpoint{},
+		Warnings:          []string{},
+		GeneratedAt:       time.Now().UTC(),
+	}
+
+	capabilities, err := c.FullCapabilities(ctx, id.ICD, id.Identifier)
+	var notFound *NotFoundError
+	switch {
+	case errors.Is(err, ErrNotRegistered):
+		err = c.checkProductionSML(ctx, id.ICD, id.Identifier, err)
+		if errors.As(err, &notFound) && notFound.Warning != "" {
+			report.Warnings = append(report.Warnings, notFound.Warning)
+		}
+		return report, nil
+	case errors.Is(err, ErrNoDocuments):
+		report.Registered = true
+		return report, nil
+	case err != nil:
+		return report, err
+	}
+
+	report.Registered = true
+	report.Warnings = append(report.Warnings, capabilities.Warnings...)
+	var warnings []string
+	report.Name, report.Country, warnings = c.participantDetails(ctx, capabilities.SMPHostname, id.ICD, id.Identifier)
+	report.Warnings = append(report.Warnings, warnings...)
+
+	documentTypes := capabilities.DocumentTypes()
+	report.DocumentTypes = append(report.DocumentTypes, documentTypes...)
+	report.Capabilities = append(report.Capabilities, matchCapabilities(documentTypes)...)
+	for _, profile := range capabilities.NationalProfiles() {
+		report.NationalProfiles = append(report.NationalProfiles, profile.Name)
+	}
+	seen := make(map[string]bool)
+	for _, docType := range documentTypes {
+		name := friendlyDocumentName(docType)
+		if !seen[name] {
+			seen[name] = true
+			report.Documents = append(report.Documents, name)
+		}
+	}
+	for _, capability := range report.Capabilities {
+		switch capability {
+		case capabilityBISBillingInvoice:
+			report.Invoice = true
+		case capabilityBISBillingCreditNote:
+			report.CreditNote = true
+		}
+	}
+	report.TransportProfiles = append(report.TransportProfiles, capabilities.TransportProfiles()...)
+	for docType, endpoints := range newWatchState(capabilities) {
+		for key, endpoint := range endpoints {
+			report.Endpoints = append(report.Endpoints, ReportEndpoint{
+				DocumentType:           docType,
+				Process:                key.Process,
+				TransportProfile:       TransportProfile(key.TransportProfile),
+				Address:                endpoint.Address,
+				CertificateFingerprint: endpoint.Fingerprint,
+			})
+		}
+	}
+	sort.Slice(report.Endpoints, func(i, j int) bool {
+		a, b := report.Endpoints[i], report.Endpoints[j]
+		if a.DocumentType != b.DocumentType {
+			return a.DocumentType < b.DocumentType
+		}
+		if a.Process != b.Process {
+			return a.Process < b.Process
+		}
+		return a.TransportProfile < b.TransportProfile
+	})
+	return report, nil
+}
+
+// OnboardingStatus says whether a participant can be invoiced over PEPPOL
+type OnboardingStatus string
+
+// Onboarding statuses, from best to worst
+const (
+	OnboardingReady         OnboardingStatus = "ready"                 // receives BIS Billing 3.0 invoices and credit notes
+	OnboardingPartial       OnboardingStatus = "partial"               // receives only one of the two, usually invoices
+	OnboardingNoBilling     OnboardingStatus = "registered_no_billing" // registered, but receives neither
+	OnboardingNotRegistered OnboardingStatus = "not_registered"
+	OnboardingError         OnboardingStatus = "error" // the lookup failed, so the status is unknown
+)
+
+// OnboardingStatuses lists the statuses in the order reports summarize them
+var OnboardingStatuses = []OnboardingStatus{
+	OnboardingReady, OnboardingPartial, OnboardingNoBilling, OnboardingNotRegistered, OnboardingError,
+}
+
+// Description is the status as shown in the onboarding table
+func (s OnboardingStatus) Description() string {
+	switch s {
+	case OnboardingReady:
+		return "ready (invoice + credit note)"
+	case OnboardingPartial:
+		return "partial"
+	case OnboardingNoBilling:
+		return "registered but no billing"
+	case OnboardingNotRegistered:
+		return "not registered"
+	case OnboardingError:
+		return "lookup failed"
+	}
+	return string(s)
+}
+
+// OnboardingResult is one participant in an OnboardingReport
+type OnboardingResult struct {
+	ParticipantID string           `json:"participant_id"`
+	Status        OnboardingStatus `json:"status"`
+	Invoice       bool             `json:"invoice"`     // supports BIS Billing 3.0 invoices
+	CreditNote    bool             `json:"credit_note"` // supports BIS Billing 3.0 credit notes
+	Name          string           `json:"name,omitempty"`
+	Country       string           `json:"country,omitempty"`
+	Error         string           `json:"error,omitempty"`
+	Warnings      []string         `json:"warnings,omitempty"`
+}
+
+// OnboardingReport sorts participants by whether they are ready to receive
+// PEPPOL BIS Billing 3.0 invoices and credit notes
+type OnboardingReport struct {
+	GeneratedAt  time.Time                `json:"generated_at"`
+	Summary      map[OnboardingStatus]int `json:"summary"` // participants per status
+	Participants []OnboardingResult       `json:"participants"`
+}
+
+// OnboardingCheck looks up the participants, up to concurrency at a time,
+// and reports each one's OnboardingStatus, in the order of ids. Support is
+// taken from the capabilities Lookup matches, so no ServiceMetadata is
+// fetched. A failed lookup is reported as OnboardingError rather than
+// returned.
+func (c *Client) OnboardingCheck(ctx context.Context, ids []ParticipantID, concurrency int) OnboardingReport {
+	report := OnboardingReport{
+		GeneratedAt:  time.Now().UTC(),
+		Summary:      make(map[OnboardingStatus]int),
+		Participants: make([]OnboardingResult, len(ids)),
+	}
+	parallel.ForEach(len(ids), concurrency, func(i int) {
+		report.Participants[i] = c.onboardingResult(ctx, ids[i])
+	})
+	for _, status := range OnboardingStatuses {
+		report.Summary[status] = 0
+	}
+	for _, r := range report.Participants {
+		report.Summary[r.Status]++
+	}
+	return report
+}
+
+// onboardingResult looks up one participant for OnboardingCheck
+func (c *Client) onboardingResult(ctx context.Context, id ParticipantID) OnboardingResult {
+	r := OnboardingResult{ParticipantID: id.String()}
+	result, err := c.Lookup(ctx, id.ICD, id.Identifier)
+	var notFound *NotFoundError
+	switch {
+	case errors.Is(err, ErrNotRegistered):
+		r.Status = OnboardingNotRegistered
+		if errors.As(err, &notFound) && notFound.Warning != "" {
+			r.Warnings = append(r.Warnings, notFound.Warning)
+		}
+		return r
+	case errors.Is(err, ErrNoDocuments):
+		r.Status = OnboardingNoBilling
+		return r
+	case err != nil:
+		r.Status, r.Error = OnboardingError, err.Error()
+		return r
+	}
+
+	r.Name, r.Country, r.Warnings = result.Name, result.Country, result.Warnings
+	for _, capability := range result.Capabilities {
+		switch capability {
+		case capabilityBISBillingInvoice:
+			r.Invoice = true
+		case capabilityBISBillingCreditNote:
+			r.CreditNote = true
+		}
+	}
+	switch {
+	case r.Invoice && r.CreditNote:
+		r.Status = OnboardingReady
+	case r.Invoice || r.CreditNote:
+		r.Status = OnboardingPartial
+	default:
+		r.Status = OnboardingNoBilling
+	}
+	return r
+}
+
+// friendlyDocumentName turns a document identifier's local name into
+// words, e.g. "Credit Note" for "...:CreditNote-2::CreditNote"
+func friendlyDocumentName(docType string) string {
+	name := ParseDocumentType(docType).LocalName
+	if name == "" {
+		return docType
+	}
+	var words strings.Builder
+	for i, r := range name {
+		if i > 0 && r >= 'A' && r <= 'Z' && !(name[i-1] >= 'A' && name[i-1] <= 'Z') {
+			words.WriteByte(' ')
+		}
+		words.WriteRune(r)
+	}
+	return words.String()
+}
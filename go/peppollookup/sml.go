@@ -0,0 +1,819 @@
+package peppollookup
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/snapbooks-app/peppol-lookup/go/internal/parallel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// acquireDNS waits for one of MaxConcurrentDNS query slots. Call the
+// returned function to release it.
+func (c *Client) acquireDNS(ctx context.Context) (func(), error) {
+	c.state.dnsSlotsOnce.Do(func() {
+		if c.MaxConcurrentDNS > 0 {
+			c.state.dnsSlots = make(chan struct{}, c.MaxConcurrentDNS)
+		}
+	})
+	if c.state.dnsSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.state.dnsSlots <- struct{}{}:
+		return func() { <-c.state.dnsSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolveHost resolves hostname while holding a DNS query slot
+func (c *Client) resolveHost(ctx context.Context, hostname string) ([]string, error) {
+	release, err := c.acquireDNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.resolver().LookupHost(ctx, hostname)
+}
+
+// lookupCNAME returns the canonical name of hostname while holding a DNS
+// query slot
+func (c *Client) lookupCNAME(ctx context.Context, hostname string) (string, error) {
+	release, err := c.acquireDNS(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return c.resolver().LookupCNAME(ctx, hostname)
+}
+
+// ErrCNAMEChainTooLong is returned when a CNAME chain exceeds MaxCNAMEDepth
+// or loops back on itself
+var ErrCNAMEChainTooLong = errors.New("CNAME chain too long")
+
+// DefaultMaxCNAMEDepth is a MaxCNAMEDepth deep enough for real SML records,
+// as used by the CLI's --debug
+const DefaultMaxCNAMEDepth = 8
+
+// DNSAnswers queries the A, AAAA and CNAME records of a participant's SML
+// hostname and the NAPTR record of their NAPTR name, and returns every
+// record in the answers, including CNAMEs followed by the resolver
+func (c *Client) DNSAnswers(ctx context.Context, icd, identifier string) ([]DNSRecord, error) {
+	hostname := c.participantHostname(icd, identifier)
+	queries := []struct {
+		name  string
+		qtype uint16
+	}{
+		{hostname, dns.TypeA},
+		{hostname, dns.TypeAAAA},
+		{hostname, dns.TypeCNAME},
+		{NAPTRHostname(icd, identifier, c.scheme(), c.SMLDomain), dns.TypeNAPTR},
+	}
+
+	var records []DNSRecord
+	seen := make(map[DNSRecord]bool)
+	for _, q := range queries {
+		answer, err := c.dnsQuery(ctx, q.name, q.qtype)
+		if err != nil {
+			return records, fmt.Errorf("failed to query %s %s: %v", dnsTypeName(q.qtype), q.name, err)
+		}
+		for _, rr := range answer.Answer {
+			header := rr.Header()
+			record := DNSRecord{Name: strings.TrimSuffix(header.Name, "."), Type: dnsTypeName(header.Rrtype), TTL: header.Ttl}
+			switch rr := rr.(type) {
+			case *dns.A:
+				record.Value = rr.A.String()
+			case *dns.AAAA:
+				record.Value = rr.AAAA.String()
+			case *dns.CNAME:
+				record.Value = strings.TrimSuffix(rr.Target, ".")
+			case *dns.NAPTR:
+				record.Value = fmt.Sprintf("%d %d %q %q %q %s",
+					rr.Order, rr.Preference, rr.Flags, rr.Service, rr.Regexp, rr.Replacement)
+			}
+			if !seen[record] {
+				seen[record] = true
+				records = append(records, record)
+			}
+		}
+	}
+	return records, nil
+}
+
+// ResolveCNAMEChain follows CNAME records from hostname one hop at a time
+// and returns hostname followed by every target, so the provider routing
+// behind an SML hostname is visible. It fails with ErrCNAMEChainTooLong
+// after MaxCNAMEDepth hops or on a loop.
+func (c *Client) ResolveCNAMEChain(ctx context.Context, hostname string) ([]string, error) {
+	name := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for {
+		answer, err := c.dnsQuery(ctx, name, dns.TypeCNAME)
+		if err != nil {
+			return chain, fmt.Errorf("failed to query CNAME of %s: %v", name, err)
+		}
+
+		next := ""
+		for _, rr := range answer.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(strings.TrimSuffix(cname.Hdr.Name, "."), name) {
+				next = strings.ToLower(strings.TrimSuffix(cname.Target, "."))
+				break
+			}
+		}
+		if next == "" {
+			return chain, nil
+		}
+		if seen[next] || len(chain) > c.MaxCNAMEDepth {
+			return chain, fmt.Errorf("%w: %s", ErrCNAMEChainTooLong, strings.Join(append(chain, next), " -> "))
+		}
+		seen[next] = true
+		chain = append(chain, next)
+		name = next
+	}
+}
+
+// lookupHost resolves hostname, retrying temporary DNS failures with
+// exponential backoff
+func (c *Client) lookupHost(ctx context.Context, hostname string) ([]string, error) {
+	backoff := c.DNSRetryBackoff
+	for attempt := 0; ; attempt++ {
+		addrs, err := c.resolveHost(ctx, hostname)
+		var dnsErr *net.DNSError
+		if err == nil || attempt >= c.DNSRetries ||
+			!errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+			return addrs, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// canonicalParticipantID returns the one form of a participant ID that SML
+// hostnames, SMP URLs and cache keys are derived from
+//
+// PEPPOL participant identifiers are case-insensitive, so both parts are
+// trimmed and lowercased: "0192:ABC", "0192:abc" and " 0192:ABC " are the
+// same participant and must map to the same hostname and cache entries.
+// Derive keys from this rather than normalizing at each call site.
+func canonicalParticipantID(icd, identifier string) string {
+	return strings.ToLower(strings.TrimSpace(icd) + ":" + strings.TrimSpace(identifier))
+}
+
+// canonical returns canonicalParticipantID of p
+func (p ParticipantID) canonical() string {
+	return canonicalParticipantID(p.ICD, p.Identifier)
+}
+
+// SMLHashInput returns the exact string hashed into a participant's SML
+// hostnames: the raw identifier value "icd:identifier", lowercased, e.g.
+// "0192:921605900"
+//
+// The PEPPOL SML specification hashes the value only. The identifier scheme
+// is not part of it, since it is a label of the hostname in its own right,
+// and the value is not percent-encoded as in SMP URLs. As a check, the
+// production SML publishes 0192:921605900 at
+// b-e258de9dbe1f34f17b55d5d3cc5e7a66, which is md5("0192:921605900");
+// md5("iso6523-actorid-upis::0192:921605900") would be
+// 7cc559fe58d22408e35c22d73744760f instead.
+func SMLHashInput(icd, identifier string) string {
+	return canonicalParticipantID(icd, identifier)
+}
+
+// smlHash returns the hex MD5 hash the SML uses for a participant
+func smlHash(icd, identifier string) string {
+	hash := md5.Sum([]byte(SMLHashInput(icd, identifier)))
+	return hex.EncodeToString(hash[:])
+}
+
+// SMLHostname builds the DNS name the SML publishes for a participant:
+// "b-" + md5(SMLHashInput) + "." + scheme + "." + domain
+//
+// A CNAME or A record at this name means the participant is registered.
+// The result is lowercase regardless of the input's casing. See
+// Client.HostnamePrefix for SMLs with another prefix than "b-".
+func SMLHostname(icd, identifier, scheme, domain string) string {
+	return prefixedSMLHostname(smlHostnamePrefix, smlHash(icd, identifier), scheme, domain)
+}
+
+// prefixedSMLHostname builds an SML hostname from its parts
+func prefixedSMLHostname(prefix, hash, scheme, domain string) string {
+	return strings.ToLower(fmt.Sprintf("%s%s.%s.%s", prefix, hash, scheme, domain))
+}
+
+// NAPTRHostname builds the DNS name of a participant's NAPTR record:
+// base32(sha256(SMLHashInput)) + "." + scheme + "." + domain
+//
+// This is the naming scheme of the PEPPOL SML specification from 2021 on,
+// where the SMP URL is published in a U-NAPTR record instead of being
+// implied by a CNAME. The same string as for smlHash is hashed; the hash is
+// unpadded and written in lowercase.
+func NAPTRHostname(icd, identifier, scheme, domain string) string {
+	hash := sha256.Sum256([]byte(SMLHashInput(icd, identifier)))
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:])
+	return strings.ToLower(fmt.Sprintf("%s.%s.%s", encoded, scheme, domain))
+}
+
+// participantHostname builds the SML DNS name of a participant
+func (c *Client) participantHostname(icd, identifier string) string {
+	return prefixedSMLHostname(c.hostnamePrefix(), smlHash(icd, identifier), c.scheme(), c.SMLDomain)
+}
+
+// DNSName returns the SML name Lookup queries for a participant, in the
+// canonical lowercase form, whatever the casing of icd and identifier.
+// Only with CaseFallback can a result's DNSName differ from it.
+func (c *Client) DNSName(icd, identifier string) string {
+	return c.participantHostname(icd, identifier)
+}
+
+// hostnamePrefix returns the SML hostname prefix in use
+func (c *Client) hostnamePrefix() string {
+	if c.HostnamePrefix == "" {
+		return smlHostnamePrefix
+	}
+	return c.HostnamePrefix
+}
+
+// Forms of the participant ID an SML hostname can be hashed from
+const (
+	SMLHashNormalized = "normalized" // lowercase, as SMLHashInput
+	SMLHashAsGiven    = "as-given"   // trimmed but with its casing kept
+)
+
+// asGivenHostname is participantHostname hashed from the participant ID
+// with its casing kept, as tried by CaseFallback
+func (c *Client) asGivenHostname(icd, identifier string) string {
+	hash := md5.Sum([]byte(strings.TrimSpace(icd) + ":" + strings.TrimSpace(identifier)))
+	return prefixedSMLHostname(c.hostnamePrefix(), hex.EncodeToString(hash[:]), c.scheme(), c.SMLDomain)
+}
+
+// smlHashForm returns which form of the participant ID smlHostname, as
+// returned by smlLookup, was hashed from
+func (c *Client) smlHashForm(icd, identifier, smlHostname string) string {
+	if smlHostname != c.participantHostname(icd, identifier) {
+		return SMLHashAsGiven
+	}
+	return SMLHashNormalized
+}
+
+// scheme returns the participant identifier scheme in use
+func (c *Client) scheme() string {
+	if c.ParticipantScheme == "" {
+		return participantScheme
+	}
+	return c.ParticipantScheme
+}
+
+// ResolveNAPTR looks up a participant's U-NAPTR record in the SML and
+// returns the SMP URL it points to
+//
+// Returns a *NotFoundError matching ErrNotRegistered if the NAPTR name does
+// not exist.
+func (c *Client) ResolveNAPTR(ctx context.Context, icd, identifier string) (string, error) {
+	hostname := NAPTRHostname(icd, identifier, c.scheme(), c.SMLDomain)
+	answer, err := c.dnsQuery(ctx, hostname, dns.TypeNAPTR)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve NAPTR %s: %v", hostname, err)
+	}
+	if c.RequireDNSSEC && !answer.AuthenticatedData {
+		return "", fmt.Errorf("%w: NAPTR %s", ErrDNSSECNotValidated, hostname)
+	}
+	if answer.Rcode == dns.RcodeNameError {
+		return "", &NotFoundError{ParticipantID: fmt.Sprintf("%s:%s", icd, identifier), Reason: ReasonNXDOMAIN, DNSName: hostname}
+	}
+	if answer.Rcode != dns.RcodeSuccess {
+		return "", fmt.Errorf("failed to resolve NAPTR %s: %s", hostname, dns.RcodeToString[answer.Rcode])
+	}
+
+	// Use the most preferred "Meta:SMP" terminal (U flag) record
+	var best *dns.NAPTR
+	for _, rr := range answer.Answer {
+		naptr, ok := rr.(*dns.NAPTR)
+		if !ok || !strings.EqualFold(naptr.Flags, "U") || naptr.Service != "Meta:SMP" {
+			continue
+		}
+		if best == nil || naptr.Order < best.Order ||
+			(naptr.Order == best.Order && naptr.Preference < best.Preference) {
+			best = naptr
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no Meta:SMP NAPTR record at %s", hostname)
+	}
+	smpURL, err := applyNAPTRRegexp(best.Regexp, hostname)
+	if err != nil {
+		return "", err
+	}
+	return asciiURL(smpURL)
+}
+
+// applyNAPTRRegexp applies a NAPTR substitution expression
+// ("!pattern!replacement!") to input
+func applyNAPTRRegexp(expr, input string) (string, error) {
+	if len(expr) < 3 {
+		return "", fmt.Errorf("invalid NAPTR regexp %q", expr)
+	}
+	parts := strings.Split(expr[1:], expr[:1])
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid NAPTR regexp %q", expr)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid NAPTR regexp %q: %v", expr, err)
+	}
+	// Convert \1-style back-references to Go's ${1}
+	replacement := regexp.MustCompile(`\\([0-9])`).ReplaceAllString(parts[1], "$${$1}")
+	return re.ReplaceAllString(input, replacement), nil
+}
+
+// smlLookup performs SML lookup using DNS lookup
+//
+// The SML is like a phone book for the PEPPOL network. Given a participant's ID:
+// 1. Create an MD5 hash of their ID (e.g., "0192:921605900")
+// 2. Use the hash to construct a DNS hostname
+// 3. If the hostname exists, the participant is registered in PEPPOL
+// 4. The hostname tells us where to find their metadata (SMP)
+//
+// Returns the SMP hostname if found, a *NotFoundError if not found
+func (c *Client) smlLookup(ctx context.Context, icd, identifier string) (string, error) {
+	ctx, span := c.startSpan(ctx, "sml.resolve")
+	span.SetAttributes(
+		attribute.String("peppol.participant_id", canonicalParticipantID(icd, identifier)),
+		attribute.String("peppol.sml_domain", c.SMLDomain),
+	)
+	hostname, err := c.resolveSML(ctx, icd, identifier)
+	if err == nil {
+		span.SetAttributes(attribute.String("peppol.smp_host", hostname))
+	}
+	endSpan(span, err)
+	return hostname, err
+}
+
+// resolveSML is smlLookup without its tracing span
+//
+// With CaseFallback, the hostname returned is the as-given one if only
+// that resolved; it is cached under the normalized hostname either way.
+// An NXDOMAIN is cached for NegativeCacheTTL, once the fallback has failed
+// too.
+func (c *Client) resolveSML(ctx context.Context, icd, identifier string) (string, error) {
+	hostname := c.participantHostname(icd, identifier)
+
+	cacheKey := "sml:" + hostname
+	negativeKey := "sml-nxdomain:" + hostname
+	if c.Cache != nil {
+		if cached, ok := c.Cache.Get(cacheKey); ok {
+			return cached, c.checkSMPPolicy(ctx, cached)
+		}
+		if _, ok := c.Cache.Get(negativeKey); ok && c.NegativeCacheTTL > 0 {
+			return "", &NotFoundError{ParticipantID: fmt.Sprintf("%s:%s", icd, identifier), Reason: ReasonNXDOMAIN, DNSName: hostname}
+		}
+	}
+
+	err := c.checkSMLHostname(ctx, icd, identifier, hostname)
+	var notFound *NotFoundError
+	if c.CaseFallback && errors.As(err, &notFound) && notFound.Reason == ReasonNXDOMAIN {
+		if asGiven := c.asGivenHostname(icd, identifier); asGiven != hostname &&
+			c.checkSMLHostname(ctx, icd, identifier, asGiven) == nil {
+			hostname, err = asGiven, nil
+		}
+	}
+	if err != nil {
+		if c.Cache != nil && c.NegativeCacheTTL > 0 && errors.As(err, &notFound) && notFound.Reason == ReasonNXDOMAIN {
+			c.Cache.Set(negativeKey, hostname, c.NegativeCacheTTL)
+		}
+		return "", err
+	}
+
+	if c.Cache != nil && c.CacheTTL > 0 {
+		c.Cache.Set(cacheKey, hostname, c.CacheTTL)
+	}
+	return hostname, c.checkSMPPolicy(ctx, hostname)
+}
+
+// checkSMLHostname checks that a participant's SML hostname exists,
+// returning a *NotFoundError if it doesn't
+func (c *Client) checkSMLHostname(ctx context.Context, icd, identifier, hostname string) error {
+	if c.RequireDNSSEC {
+		return c.validatedLookup(ctx, icd, identifier, hostname)
+	}
+
+	_, err := c.lookupHost(ctx, hostname)
+	if err == nil {
+		return nil
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		// A CNAME without addresses behind it means the participant is
+		// registered but their SMP record is broken
+		reason := ReasonNXDOMAIN
+		if cname, err := c.lookupCNAME(ctx, hostname); err == nil &&
+			!strings.EqualFold(strings.TrimSuffix(cname, "."), hostname) {
+			reason = ReasonNoServices
+		}
+		return &NotFoundError{ParticipantID: fmt.Sprintf("%s:%s", icd, identifier), Reason: reason, DNSName: hostname}
+	}
+	return fmt.Errorf("failed to resolve %s: %v", hostname, err)
+}
+
+// ErrSMPNotAllowed is matched by a *PolicyError
+var ErrSMPNotAllowed = errors.New("SMP provider is not allowed")
+
+// PolicyError is returned when a participant's SMP is excluded by the
+// client's AllowedSMPDomains or DeniedSMPDomains
+type PolicyError struct {
+	ParticipantHostname string // the SML hostname of the participant
+	SMPHost             string // the canonical SMP host it points to
+	Denied              bool   // true if matched by DeniedSMPDomains, false if absent from AllowedSMPDomains
+}
+
+func (e *PolicyError) Error() string {
+	if e.Denied {
+		return fmt.Sprintf("SMP %s is on the deny list", e.SMPHost)
+	}
+	return fmt.Sprintf("SMP %s is not on the allow list", e.SMPHost)
+}
+
+// Is makes errors.Is(err, ErrSMPNotAllowed) true
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrSMPNotAllowed
+}
+
+// matchesDomain reports whether host is domain or one of its subdomains
+func matchesDomain(host, domain string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain = strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(domain, "."), "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// checkSMPPolicy resolves the canonical host behind a participant's SML
+// hostname and checks it against the allow and deny lists
+func (c *Client) checkSMPPolicy(ctx context.Context, hostname string) error {
+	if len(c.AllowedSMPDomains) == 0 && len(c.DeniedSMPDomains) == 0 {
+		return nil
+	}
+
+	// The SML hostname is a CNAME to the provider's SMP host
+	smpHost, err := c.lookupCNAME(ctx, hostname)
+	if err != nil {
+		return fmt.Errorf("failed to resolve SMP host of %s: %v", hostname, err)
+	}
+	smpHost = strings.TrimSuffix(smpHost, ".")
+
+	for _, domain := range c.DeniedSMPDomains {
+		if matchesDomain(smpHost, domain) {
+			return &PolicyError{ParticipantHostname: hostname, SMPHost: smpHost, Denied: true}
+		}
+	}
+	if len(c.AllowedSMPDomains) == 0 {
+		return nil
+	}
+	for _, domain := range c.AllowedSMPDomains {
+		if matchesDomain(smpHost, domain) {
+			return nil
+		}
+	}
+	return &PolicyError{ParticipantHostname: hostname, SMPHost: smpHost}
+}
+
+// ErrDNSSECNotValidated is returned with RequireDNSSEC when the resolver
+// did not validate an SML answer
+var ErrDNSSECNotValidated = errors.New("DNS answer not DNSSEC-validated")
+
+// validatedLookup is the RequireDNSSEC form of the SML hostname check in
+// smlLookup. It fails with ErrDNSSECNotValidated unless the resolver set
+// the AD bit, which also covers authenticated denial of existence. The AD
+// bit is taken on trust; no signatures are checked.
+func (c *Client) validatedLookup(ctx context.Context, icd, identifier, hostname string) error {
+	participantID := fmt.Sprintf("%s:%s", icd, identifier)
+	hasCNAME := false
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answer, err := c.dnsQuery(ctx, hostname, qtype)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %v", hostname, err)
+		}
+		if !answer.AuthenticatedData {
+			return fmt.Errorf("%w: %s %s", ErrDNSSECNotValidated, dnsTypeName(qtype), hostname)
+		}
+		if answer.Rcode == dns.RcodeNameError {
+			return &NotFoundError{ParticipantID: participantID, Reason: ReasonNXDOMAIN, DNSName: hostname}
+		}
+		if answer.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("failed to resolve %s: %s", hostname, dns.RcodeToString[answer.Rcode])
+		}
+		for _, rr := range answer.Answer {
+			switch rr.Header().Rrtype {
+			case qtype:
+				return nil
+			case dns.TypeCNAME:
+				hasCNAME = true
+			}
+		}
+	}
+	// As in smlLookup, a CNAME without addresses behind it means the SMP
+	// record is broken
+	if hasCNAME {
+		return &NotFoundError{ParticipantID: participantID, Reason: ReasonNoServices, DNSName: hostname}
+	}
+	return &NotFoundError{ParticipantID: participantID, Reason: ReasonNXDOMAIN, DNSName: hostname}
+}
+
+// dnsServers returns DNSServer, or else the nameservers in
+// /etc/resolv.conf in order. Systems without that file, such as Windows,
+// must set DNSServer for the queries dnsQuery makes.
+func (c *Client) dnsServers() ([]string, error) {
+	if c.DNSServer != "" {
+		return []string{c.DNSServer}, nil
+	}
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("no system nameserver, set DNSServer (--dns-server): %v", err)
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.New("no nameserver in /etc/resolv.conf, set DNSServer (--dns-server)")
+	}
+	servers := make([]string, len(config.Servers))
+	for i, server := range config.Servers {
+		servers[i] = net.JoinHostPort(server, config.Port)
+	}
+	return servers, nil
+}
+
+// dnsQuery sends a single recursive query for name and qtype and returns
+// the response, whatever its response code
+//
+// net.Resolver only exposes addresses and CNAMEs, so record types such as
+// NAPTR and the AD bit are queried with github.com/miekg/dns instead. Each
+// nameserver from dnsServers is tried in turn until one answers. Queries
+// use UDP, falling back to TCP when the response is truncated, or TCP only
+// through a SOCKS5 proxy. With RequireDNSSEC the query asks for DNSSEC
+// records and validation.
+func (c *Client) dnsQuery(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	release, err := c.acquireDNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	servers, err := c.dnsServers()
+	if err != nil {
+		return nil, err
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qtype)
+	query.SetEdns0(dns.DefaultMsgSize, c.RequireDNSSEC)
+	if c.RequireDNSSEC {
+		// The AD bit asks the resolver to validate (RFC 6840 section 5.7)
+		query.AuthenticatedData = true
+	}
+
+	network := "udp"
+	if c.SOCKS5Proxy != "" {
+		network = "tcp"
+	}
+	for _, server := range servers {
+		var response *dns.Msg
+		response, err = c.exchangeDNS(ctx, network, server, query)
+		if err == nil && response.Truncated && network == "udp" {
+			response, err = c.exchangeDNS(ctx, "tcp", server, query)
+		}
+		if err == nil {
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// exchangeDNS sends query to server, connecting through the SOCKS5 proxy
+// if one is set
+func (c *Client) exchangeDNS(ctx context.Context, network, server string, query *dns.Msg) (*dns.Msg, error) {
+	conn, err := c.dialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	client := &dns.Client{Net: network}
+	response, _, err := client.ExchangeWithConnContext(ctx, query, &dns.Conn{Conn: conn})
+	return response, err
+}
+
+// dnsTypeName returns the mnemonic of a DNS record type, e.g. "NAPTR"
+func dnsTypeName(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
+// CheckSMLHealth confirms that the SML DNS zone answers by resolving
+// HealthCheckParticipant, bypassing the cache
+//
+// Run it before a large batch to catch an unreachable SML up front. It
+// returns how long the resolution took.
+func (c *Client) CheckSMLHealth(ctx context.Context) (time.Duration, error) {
+	icd, identifier, ok := strings.Cut(c.HealthCheckParticipant, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid health check participant %q", c.HealthCheckParticipant)
+	}
+	hostname := c.participantHostname(icd, identifier)
+
+	start := time.Now()
+	_, err := c.lookupHost(ctx, hostname)
+	elapsed := time.Since(start)
+	if err != nil {
+		return elapsed, fmt.Errorf("SML %s is not answering: failed to resolve %s: %v", c.SMLDomain, hostname, err)
+	}
+	return elapsed, nil
+}
+
+// CheckSMPHostReachable verifies that an SMP host ("host" or "host:port")
+// resolves and accepts connections on its HTTP port, through SOCKS5Proxy if
+// one is set
+func (c *Client) CheckSMPHostReachable(ctx context.Context, host string) error {
+	address := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		address = net.JoinHostPort(asciiHostname(host), "80")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := c.dialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("SMP host %s is not reachable: %v", host, err)
+	}
+	return conn.Close()
+}
+
+// checkSMLConsistency compares the SMP host a participant's CNAME points to
+// with the one in their NAPTR record and describes any disagreement
+//
+// Both records should point to the same SMP; a mismatch usually means a
+// provider migration only half completed. Nothing is reported unless both
+// records exist.
+func (c *Client) checkSMLConsistency(ctx context.Context, icd, identifier, hostname string) string {
+	smpURL, err := c.ResolveNAPTR(ctx, icd, identifier)
+	if err != nil {
+		return ""
+	}
+	naptrURL, err := url.Parse(smpURL)
+	if err != nil || naptrURL.Hostname() == "" {
+		return fmt.Sprintf("NAPTR record points to an invalid SMP URL %q", smpURL)
+	}
+
+	cname, err := c.lookupCNAME(ctx, hostname)
+	if err != nil {
+		return ""
+	}
+	cname = strings.TrimSuffix(cname, ".")
+	if strings.EqualFold(cname, hostname) {
+		return "" // no CNAME, the SML hostname has its own address records
+	}
+
+	if !strings.EqualFold(cname, naptrURL.Hostname()) {
+		return fmt.Sprintf("SML records disagree: CNAME points to SMP %s but NAPTR points to %s",
+			cname, naptrURL.Hostname())
+	}
+	return ""
+}
+
+// IsRegistered reports whether a participant is registered in the SML,
+// without querying their SMP
+func (c *Client) IsRegistered(ctx context.Context, icd, identifier string) (bool, error) {
+	_, err := c.smlLookup(ctx, icd, identifier)
+	if errors.Is(err, ErrNotRegistered) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RegistrationByEnvironment checks concurrently whether a participant is
+// registered in the SML of each environment, e.g. DefaultEnvironments, and
+// maps environment names to the outcome. This tells a participant that is
+// live in production from one only registered in test.
+//
+// Only the SML is queried, with a copy of c that differs only in the SML
+// domain, participant scheme and hostname prefix, so it shares c's
+// settings, cache and connection state. If some
+// environments can't be checked, the others are returned together with an
+// error listing the failures.
+func (c *Client) RegistrationByEnvironment(ctx context.Context, id ParticipantID, environments map[string]Environment) (map[string]bool, error) {
+	names := make([]string, 0, len(environments))
+	for name := range environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	registered := make([]bool, len(names))
+	errs := make([]error, len(names))
+	parallel.ForEach(len(names), len(names), func(i int) {
+		env := environments[names[i]]
+		sml := *c
+		sml.SMLDomain = env.SMLDomain
+		sml.ParticipantScheme = env.Scheme
+		sml.HostnamePrefix = env.HostnamePrefix
+		registered[i], errs[i] = sml.IsRegistered(ctx, id.ICD, id.Identifier)
+	})
+
+	byEnvironment := make(map[string]bool, len(names))
+	var failures []error
+	for i, name := range names {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("%s: %v", name, errs[i]))
+			continue
+		}
+		byEnvironment[name] = registered[i]
+	}
+	return byEnvironment, errors.Join(failures...)
+}
+
+// checkProductionSML adds a Warning to err if it says a participant isn't
+// registered in the test SML but they are registered in production, the
+// usual reason real participants seem to be missing. Other errors, and
+// lookups against any other SML, are returned unchanged.
+func (c *Client) checkProductionSML(ctx context.Context, icd, identifier string, err error) error {
+	var notFound *NotFoundError
+	if !c.CheckProductionSML || c.SMLDomain != testSMLDomain ||
+		!errors.As(err, &notFound) || notFound.Reason != ReasonNXDOMAIN {
+		return err
+	}
+	production := DefaultEnvironments["production"]
+	registered, checkErr := c.RegistrationByEnvironment(ctx, ParticipantID{ICD: icd, Identifier: identifier},
+		map[string]Environment{production.Name: production})
+	if checkErr != nil || !registered[production.Name] {
+		return err
+	}
+	notFound.Warning = fmt.Sprintf("%s is not registered in the test SML but is registered in production", notFound.ParticipantID)
+	return notFound
+}
+
+// SMPHost returns the canonical SMP host a participant's SML hostname
+// points to
+func (c *Client) SMPHost(ctx context.Context, icd, identifier string) (string, error) {
+	hostname, err := c.smlLookup(ctx, icd, identifier)
+	if err != nil {
+		return "", err
+	}
+	cname, err := c.lookupCNAME(ctx, hostname)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve SMP host of %s: %v", hostname, err)
+	}
+	return strings.ToLower(strings.TrimSuffix(cname, ".")), nil
+}
+
+// GroupBySMPHost resolves each participant's canonical SMP host and groups
+// the participants by it, showing which share a provider
+//
+// Duplicate IDs are resolved once and unregistered participants are left
+// out. If some participants fail to resolve, the groups of the others are
+// returned together with an error listing the failures.
+func (c *Client) GroupBySMPHost(ctx context.Context, ids []ParticipantID) (map[string][]ParticipantID, error) {
+	unique := make([]ParticipantID, 0, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !seen[id.canonical()] {
+			seen[id.canonical()] = true
+			unique = append(unique, id)
+		}
+	}
+
+	hosts := make([]string, len(unique))
+	errs := make([]error, len(unique))
+	parallel.ForEach(len(unique), c.MaxConcurrentDNS, func(i int) {
+		hosts[i], errs[i] = c.SMPHost(ctx, unique[i].ICD, unique[i].Identifier)
+	})
+
+	groups := make(map[string][]ParticipantID)
+	var failures []error
+	for i, id := range unique {
+		switch err := errs[i]; {
+		case errors.Is(err, ErrNotRegistered):
+		case err != nil:
+			failures = append(failures, fmt.Errorf("%s: %v", id, err))
+		default:
+			groups[hosts[i]] = append(groups[hosts[i]], id)
+		}
+	}
+	return groups, errors.Join(failures...)
+}
@@ -0,0 +1,1001 @@
+package peppollookup
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// SMPHostURL builds the base URL of the SMP served at smpHostname.
+// Participant and document paths are appended to it.
+func SMPHostURL(smpHostname string) string {
+	return "http://" + asciiHostname(smpHostname)
+}
+
+// asciiHostname converts an internationalized hostname, optionally with a
+// port, to the ASCII form used on the wire with the IDNA lookup profile,
+// e.g. bücher.example to xn--bcher-kva.example. Hostnames that are already
+// ASCII or aren't valid IDNA are returned unchanged.
+func asciiHostname(host string) string {
+	if strings.IndexFunc(host, func(r rune) bool { return r >= 0x80 }) < 0 {
+		return host
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return host
+	}
+	if port != "" {
+		return net.JoinHostPort(ascii, port)
+	}
+	return ascii
+}
+
+// asciiURL converts the host of rawURL with asciiHostname
+func asciiURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+	host := asciiHostname(u.Hostname())
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	return u.String(), nil
+}
+
+// escapePathSegment percent-encodes an identifier for use as one SMP URL
+// path segment
+//
+// The SMP specifications encode the whole "scheme::value" identifier,
+// including the "::" separator, which is also how SMPs write the hrefs in
+// their own ServiceGroups. url.PathEscape leaves ':' alone and
+// url.QueryEscape turns spaces into '+', so neither is right on its own.
+func escapePathSegment(id string) string {
+	return strings.ReplaceAll(url.PathEscape(id), ":", "%3A")
+}
+
+// SMPBaseURL resolves a participant through the SML and returns the base
+// URL of their SMP without querying it
+//
+// This is useful for tools that want to build their own SMP queries.
+// Returns a *NotFoundError matching ErrNotRegistered if the participant has
+// no SML record.
+func (c *Client) SMPBaseURL(ctx context.Context, icd, identifier string) (string, error) {
+	smpHostname, err := c.smlLookup(ctx, icd, identifier)
+	if err != nil {
+		return "", err
+	}
+	return SMPHostURL(smpHostname), nil
+}
+
+// SMPBaseURL calls DefaultClient.SMPBaseURL
+func SMPBaseURL(ctx context.Context, icd, identifier string) (string, error) {
+	return DefaultClient.SMPBaseURL(ctx, icd, identifier)
+}
+
+// serviceGroupXML is the part of an SMP ServiceGroup response we use.
+// Element names are matched regardless of XML namespace.
+type serviceGroupXML struct {
+	XMLName               xml.Name
+	ParticipantIdentifier struct {
+		Scheme string `xml:"scheme,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"ParticipantIdentifier"`
+	References []struct {
+		Href string `xml:"href,attr"`
+	} `xml:"ServiceMetadataReferenceCollection>ServiceMetadataReference"`
+
+	// SMP 2.0 lists document identifiers instead of hrefs
+	SMPVersionID  string `xml:"SMPVersionID"`
+	ParticipantID struct {
+		Scheme string `xml:"schemeID,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"ParticipantID"`
+	ServiceReferences []struct {
+		ID struct {
+			Scheme string `xml:"schemeID,attr"`
+			Value  string `xml:",chardata"`
+		} `xml:"ID"`
+	} `xml:"ServiceReference"`
+}
+
+// serviceGroupJSON is the JSON representation of a ServiceGroup some SMPs
+// serve instead of XML
+type serviceGroupJSON struct {
+	ParticipantID string `json:"participantID"`
+	URLs          []struct {
+		Href           string `json:"href"`
+		DocumentTypeID string `json:"documentTypeID"`
+	} `json:"urls"`
+}
+
+// smp2Namespace prefixes the XML namespaces of OASIS SMP 2.0 documents
+const smp2Namespace = "http://docs.oasis-open.org/bdxr/ns/SMP/2/"
+
+// smpVersion tells SMP 2.0 documents from SMP 1.0 ones (PEPPOL's busdox
+// and OASIS BDXR 1.0) by their root element namespace. Both are served as
+// application/xml, so the Content-Type doesn't distinguish them.
+func smpVersion(root xml.Name) string {
+	if strings.HasPrefix(root.Space, smp2Namespace) {
+		return "2.0"
+	}
+	return "1.0"
+}
+
+// serviceGroupURL builds the URL of a participant's ServiceGroup on the SMP
+// at baseURL
+func (c *Client) serviceGroupURL(baseURL, icd, identifier string) string {
+	return c.serviceGroupURLEncoded(baseURL, icd, identifier, escapePathSegment)
+}
+
+// serviceGroupURLEncoded is serviceGroupURL with the participant identifier
+// path segment encoded by escape
+func (c *Client) serviceGroupURLEncoded(baseURL, icd, identifier string, escape func(string) string) string {
+	// Construct SMP URL
+	// Format: http://[SMP hostname]/[identifier scheme]::[participant identifier]
+	return baseURL + "/" + escape(c.scheme()+"::"+canonicalParticipantID(icd, identifier))
+}
+
+// participantIDEncodings are the ways of writing the participant identifier
+// in a ServiceGroup URL, in the order they're tried. The specifications
+// percent-encode the colons, but some legacy SMPs only answer for literal
+// ones and return 404 otherwise.
+var participantIDEncodings = []struct {
+	name   string
+	escape func(string) string
+}{
+	{idEncodingPercent, escapePathSegment},
+	{"literal colons", url.PathEscape},
+}
+
+// idEncodingPercent names the participant ID encoding the specifications use
+const idEncodingPercent = "percent-encoded"
+
+// serviceGroupWarnings describes anything odd about how the SMP answered
+// a ServiceGroup request for icd:identifier: a ServiceGroup found only
+// through a fallback participant ID encoding, or one that says it belongs
+// to someone else, as a misconfigured SMP or caching proxy might serve
+func (c *Client) serviceGroupWarnings(debug *DebugInfo, icd, identifier string) []string {
+	var warnings []string
+	if debug.IDEncoding != "" && debug.IDEncoding != idEncodingPercent {
+		warnings = append(warnings, fmt.Sprintf("SMP only found the participant with %s in the ServiceGroup URL", debug.IDEncoding))
+	}
+	if debug.ParticipantID != "" {
+		scheme, value, found := strings.Cut(debug.ParticipantID, "::")
+		if !found {
+			scheme, value = "", debug.ParticipantID
+		}
+		echoedICD, echoedIdentifier, _ := strings.Cut(value, ":")
+		if (scheme != "" && !strings.EqualFold(scheme, c.scheme())) ||
+			canonicalParticipantID(echoedICD, echoedIdentifier) != canonicalParticipantID(icd, identifier) {
+			warnings = append(warnings, fmt.Sprintf("SMP returned the ServiceGroup of %s instead of %s::%s",
+				debug.ParticipantID, c.scheme(), canonicalParticipantID(icd, identifier)))
+		}
+	}
+	return warnings
+}
+
+// echoedParticipantID formats the participant identifier a ServiceGroup
+// names, or returns "" if it names none
+func echoedParticipantID(scheme, value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" || scheme == "" {
+		return value
+	}
+	return scheme + "::" + value
+}
+
+// serviceMetadataURL builds the URL of the ServiceMetadata for one of a
+// participant's document types
+//
+// Format: [ServiceGroup URL]/services/busdox-docid-qns::[document identifier]
+func (c *Client) serviceMetadataURL(baseURL, icd, identifier, docType string) string {
+	return c.serviceGroupURL(baseURL, icd, identifier) + "/services/" +
+		escapePathSegment("busdox-docid-qns::"+docType)
+}
+
+// fetchServiceGroup returns the ServiceMetadata URLs listed in a
+// participant's ServiceGroup on the SMP at baseURL, and the SMP
+// specification version ("1.0" or "2.0") the ServiceGroup follows
+//
+// A missing or empty ServiceGroup returns a *NotFoundError with
+// ReasonSMPEmpty, after EmptyRetries further attempts; a response that
+// isn't a ServiceGroup is a parse error.
+func (c *Client) fetchServiceGroup(ctx context.Context, baseURL, icd, identifier string) (hrefs []string, version string, err error) {
+	for attempt := 0; ; attempt++ {
+		hrefs, version, err := c.fetchServiceGroupOnce(ctx, baseURL, icd, identifier)
+		if attempt >= c.EmptyRetries || !errors.Is(err, ErrNoDocuments) {
+			return hrefs, version, err
+		}
+		select {
+		case <-time.After(c.EmptyRetryDelay):
+		case <-ctx.Done():
+			return nil, "", err
+		}
+	}
+}
+
+// fetchServiceGroupOnce is fetchServiceGroup without retries
+func (c *Client) fetchServiceGroupOnce(ctx context.Context, baseURL, icd, identifier string) ([]string, string, error) {
+	participantID := fmt.Sprintf("%s:%s", icd, identifier)
+	debug, _ := ctx.Value(debugInfoKey{}).(*DebugInfo)
+
+	// Try each encoding of the participant ID until the SMP finds it
+	var urlStr string
+	var body []byte
+	var isJSON, found bool
+	for _, encoding := range participantIDEncodings {
+		urlStr = c.serviceGroupURLEncoded(baseURL, icd, identifier, encoding.escape)
+		if debug != nil {
+			debug.Redirects = nil
+		}
+		var err error
+		body, isJSON, err = c.getSMPDocument(ctx, urlStr)
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if debug != nil {
+			debug.IDEncoding = encoding.name
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, "", &NotFoundError{ParticipantID: participantID, Reason: ReasonSMPEmpty}
+	}
+
+	if isJSON {
+		var group serviceGroupJSON
+		if err := json.Unmarshal(body, &group); err != nil {
+			return nil, "", fmt.Errorf("failed to parse ServiceGroup: %v", err)
+		}
+		if debug != nil {
+			debug.ParticipantID = strings.TrimSpace(group.ParticipantID)
+		}
+		hrefs := make([]string, 0, len(group.URLs))
+		for _, ref := range group.URLs {
+			hrefs = append(hrefs, resolveHref(urlStr, ref.Href))
+		}
+		if len(hrefs) == 0 {
+			return nil, "1.0", &NotFoundError{ParticipantID: participantID, Reason: ReasonSMPEmpty}
+		}
+		return hrefs, "1.0", nil
+	}
+
+	if c.CheckStructure {
+		if err := CheckSMPStructure(body); err != nil {
+			return nil, "", fmt.Errorf("invalid ServiceGroup: %w", err)
+		}
+	}
+
+	var group serviceGroupXML
+	if err := xml.Unmarshal(body, &group); err != nil {
+		return nil, "", fmt.Errorf("failed to parse ServiceGroup: %v", err)
+	}
+	if group.XMLName.Local != "ServiceGroup" {
+		return nil, "", fmt.Errorf("failed to parse ServiceGroup: unexpected root element <%s>", group.XMLName.Local)
+	}
+	version := smpVersion(group.XMLName)
+	if debug != nil {
+		debug.ParticipantID = echoedParticipantID(group.ParticipantIdentifier.Scheme, group.ParticipantIdentifier.Value)
+		if version == "2.0" {
+			debug.ParticipantID = echoedParticipantID(group.ParticipantID.Scheme, group.ParticipantID.Value)
+		}
+	}
+
+	hrefs := make([]string, 0, len(group.References)+len(group.ServiceReferences))
+	for _, ref := range group.References {
+		hrefs = append(hrefs, resolveHref(urlStr, ref.Href))
+	}
+	// SMP 2.0 ServiceMetadata lives under the ServiceGroup's own URL
+	for _, ref := range group.ServiceReferences {
+		docID := strings.TrimSpace(ref.ID.Value)
+		if ref.ID.Scheme != "" {
+			docID = ref.ID.Scheme + "::" + docID
+		}
+		hrefs = append(hrefs, urlStr+"/services/"+escapePathSegment(docID))
+	}
+
+	// A valid ServiceGroup without references means the participant is
+	// registered but doesn't publish any document types (yet)
+	if len(hrefs) == 0 {
+		return nil, version, &NotFoundError{ParticipantID: participantID, Reason: ReasonSMPEmpty}
+	}
+	return hrefs, version, nil
+}
+
+// resolveHref makes a ServiceMetadataReference href absolute, resolving it
+// against the URL of the ServiceGroup it came from. SMPs should publish
+// absolute hrefs, but a relative one is still usable this way.
+func resolveHref(serviceGroupURL, href string) string {
+	href = strings.TrimSpace(href)
+	base, err := url.Parse(serviceGroupURL)
+	if err != nil {
+		return href
+	}
+	ref, err := url.Parse(href)
+	if err != nil || ref.IsAbs() {
+		return href
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// parseXSDDateTime parses the xsd:dateTime and xsd:date values SMPs use for
+// activation and expiration dates. Values without a timezone are taken as UTC.
+func parseXSDDateTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	layouts := []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02Z07:00",
+		"2006-01-02",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// serviceInformationXML is the ServiceInformation element of a
+// ServiceMetadata response
+type serviceInformationXML struct {
+	DocumentIdentifier string       `xml:"DocumentIdentifier"`
+	Processes          []processXML `xml:"ProcessList>Process"`
+}
+
+type processXML struct {
+	ProcessIdentifier string        `xml:"ProcessIdentifier"`
+	Endpoints         []endpointXML `xml:"ServiceEndpointList>Endpoint"`
+}
+
+type endpointXML struct {
+	TransportProfile string `xml:"transportProfile,attr"`
+	Address          string `xml:"EndpointReference>Address"`
+	EndpointURI      string `xml:"EndpointURI"`
+	Certificate      string `xml:"Certificate"`
+	ActivationDate   string `xml:"ServiceActivationDate"`
+	ExpirationDate   string `xml:"ServiceExpirationDate"`
+
+	ServiceDescription         string `xml:"ServiceDescription"`
+	TechnicalContactURL        string `xml:"TechnicalContactUrl"`
+	MinimumAuthenticationLevel string `xml:"MinimumAuthenticationLevel"`
+}
+
+// serviceMetadata2XML is the part of an OASIS SMP 2.0 ServiceMetadata
+// response we use. Several processes may share one list of endpoints.
+type serviceMetadata2XML struct {
+	DocumentIdentifier string `xml:"ID"`
+	ProcessMetadata    []struct {
+		ProcessIdentifiers []string `xml:"Process>ID"`
+		Endpoints          []struct {
+			TransportProfile string `xml:"TransportProfileID"`
+			Address          string `xml:"AddressURI"`
+			Certificate      string `xml:"Certificate>ContentBinaryObject"`
+			ActivationDate   string `xml:"ActivationDate"`
+			ExpirationDate   string `xml:"ExpirationDate"`
+			Description      string `xml:"Description"`
+			ContactURI       string `xml:"ContactURI"`
+		} `xml:"Endpoint"`
+	} `xml:"ProcessMetadata"`
+}
+
+// serviceInformation maps SMP 2.0 metadata onto the SMP 1.0 structure
+func (doc serviceMetadata2XML) serviceInformation() serviceInformationXML {
+	info := serviceInformationXML{DocumentIdentifier: doc.DocumentIdentifier}
+	for _, pm := range doc.ProcessMetadata {
+		var endpoints []endpointXML
+		for _, e := range pm.Endpoints {
+			endpoints = append(endpoints, endpointXML{
+				TransportProfile:    e.TransportProfile,
+				Address:             e.Address,
+				Certificate:         e.Certificate,
+				ActivationDate:      e.ActivationDate,
+				ExpirationDate:      e.ExpirationDate,
+				ServiceDescription:  e.Description,
+				TechnicalContactURL: e.ContactURI,
+			})
+		}
+		for _, id := range pm.ProcessIdentifiers {
+			info.Processes = append(info.Processes, processXML{ProcessIdentifier: id, Endpoints: endpoints})
+		}
+	}
+	return info
+}
+
+// serviceMetadataJSON is the JSON representation of a ServiceMetadata
+// document. Identifiers may carry their scheme ("busdox-docid-qns::...").
+type serviceMetadataJSON struct {
+	DocumentTypeID string `json:"documentTypeID"`
+	Processes      []struct {
+		ProcessID string `json:"processID"`
+		Endpoints []struct {
+			TransportProfile           string `json:"transportProfile"`
+			EndpointReference          string `json:"endpointReference"`
+			Certificate                string `json:"certificate"`
+			ServiceActivationDate      string `json:"serviceActivationDate"`
+			ServiceExpirationDate      string `json:"serviceExpirationDate"`
+			ServiceDescription         string `json:"serviceDescription"`
+			TechnicalContactURL        string `json:"technicalContactUrl"`
+			MinimumAuthenticationLevel string `json:"minimumAuthenticationLevel"`
+		} `json:"endpoints"`
+	} `json:"processes"`
+}
+
+// serviceInformation maps JSON metadata onto the XML structure
+func (doc serviceMetadataJSON) serviceInformation() serviceInformationXML {
+	info := serviceInformationXML{DocumentIdentifier: trimIdentifierScheme(doc.DocumentTypeID)}
+	for _, p := range doc.Processes {
+		process := processXML{ProcessIdentifier: trimIdentifierScheme(p.ProcessID)}
+		for _, e := range p.Endpoints {
+			process.Endpoints = append(process.Endpoints, endpointXML{
+				TransportProfile:           e.TransportProfile,
+				Address:                    e.EndpointReference,
+				Certificate:                e.Certificate,
+				ActivationDate:             e.ServiceActivationDate,
+				ExpirationDate:             e.ServiceExpirationDate,
+				ServiceDescription:         e.ServiceDescription,
+				TechnicalContactURL:        e.TechnicalContactURL,
+				MinimumAuthenticationLevel: e.MinimumAuthenticationLevel,
+			})
+		}
+		info.Processes = append(info.Processes, process)
+	}
+	return info
+}
+
+// trimIdentifierScheme drops the document or process identifier scheme
+// from a "scheme::value" identifier, as XML documents carry it separately
+func trimIdentifierScheme(id string) string {
+	for _, scheme := range []string{"busdox-docid-qns::", "peppol-doctype-wildcard::", "cenbii-procid-ubl::"} {
+		if strings.HasPrefix(id, scheme) {
+			return id[len(scheme):]
+		}
+	}
+	return id
+}
+
+// serviceMetadataXML accepts both a SignedServiceMetadata envelope and a
+// bare ServiceMetadata root element
+type serviceMetadataXML struct {
+	Signed serviceInformationXML `xml:"ServiceMetadata>ServiceInformation"`
+	Bare   serviceInformationXML `xml:"ServiceInformation"`
+}
+
+// parseEndpointURL parses an endpoint address, which must be an absolute
+// http or https URL
+func parseEndpointURL(address string) (*url.URL, error) {
+	if address == "" {
+		return nil, errors.New("endpoint has no address")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint address %q: %v", address, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint address %q: not an absolute http(s) URL", address)
+	}
+	return u, nil
+}
+
+// fetchServiceMetadata fetches and parses the ServiceMetadata at href
+func (c *Client) fetchServiceMetadata(ctx context.Context, href string) (*ServiceMetadata, error) {
+	body, isJSON, err := c.getSMPDocument(ctx, href)
+	if err != nil {
+		return nil, err
+	}
+
+	var root struct{ XMLName xml.Name }
+	if !isJSON {
+		if err := xml.Unmarshal(body, &root); err != nil {
+			return nil, &ParseError{URL: href, Err: err}
+		}
+		if c.CheckStructure {
+			if err := CheckSMPStructure(body); err != nil {
+				return nil, &ParseError{URL: href, Err: err}
+			}
+		}
+	}
+	var info serviceInformationXML
+	if isJSON {
+		var doc serviceMetadataJSON
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, &ParseError{URL: href, Err: err}
+		}
+		info = doc.serviceInformation()
+	} else if smpVersion(root.XMLName) == "2.0" {
+		var doc serviceMetadata2XML
+		if err := xml.Unmarshal(body, &doc); err != nil {
+			return nil, &ParseError{URL: href, Err: err}
+		}
+		info = doc.serviceInformation()
+	} else {
+		var doc serviceMetadataXML
+		if err := xml.Unmarshal(body, &doc); err != nil {
+			return nil, &ParseError{URL: href, Err: err}
+		}
+		info = doc.Signed
+		if info.DocumentIdentifier == "" {
+			info = doc.Bare
+		}
+	}
+	if info.DocumentIdentifier == "" {
+		return nil, &ParseError{URL: href, Err: errors.New("no ServiceInformation")}
+	}
+
+	metadata := &ServiceMetadata{DocumentType: strings.TrimSpace(info.DocumentIdentifier)}
+	for _, p := range info.Processes {
+		process := Process{ID: strings.TrimSpace(p.ProcessIdentifier)}
+		for _, e := range p.Endpoints {
+			// PEPPOL SMPs use a WS-Addressing EndpointReference, OASIS SMPs an EndpointURI
+			address := e.Address
+			if address == "" {
+				address = e.EndpointURI
+			}
+			endpointURL, err := parseEndpointURL(strings.TrimSpace(address))
+			if err != nil {
+				return nil, &ParseError{URL: href, Err: err}
+			}
+			activation, err := parseXSDDateTime(e.ActivationDate)
+			if err != nil {
+				return nil, &ParseError{URL: href, Err: fmt.Errorf("invalid ServiceActivationDate: %v", err)}
+			}
+			expiration, err := parseXSDDateTime(e.ExpirationDate)
+			if err != nil {
+				return nil, &ParseError{URL: href, Err: fmt.Errorf("invalid ServiceExpirationDate: %v", err)}
+			}
+			endpoint := Endpoint{
+				TransportProfile: ParseTransportProfile(e.TransportProfile),
+				Address:          strings.TrimSpace(address),
+				URL:              endpointURL,
+				Certificate:      strings.Join(strings.Fields(e.Certificate), ""),
+				ActivationDate:   activation,
+				ExpirationDate:   expiration,
+
+				ServiceDescription:         strings.TrimSpace(e.ServiceDescription),
+				TechnicalContactURL:        strings.TrimSpace(e.TechnicalContactURL),
+				MinimumAuthenticationLevel: strings.TrimSpace(e.MinimumAuthenticationLevel),
+			}
+			endpoint.checkCertificateExpiry(time.Now(), c.CertExpiryWindow)
+			process.Endpoints = append(process.Endpoints, endpoint)
+		}
+		metadata.Processes = append(metadata.Processes, process)
+	}
+	return metadata, nil
+}
+
+// ParseError is returned when an SMP document was fetched but is malformed
+type ParseError struct {
+	URL string
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("failed to parse ServiceMetadata from %s: %v", e.URL, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// fetchAllServiceMetadata fetches the ServiceMetadata behind each href
+// concurrently, at most MaxConcurrentFetches at a time
+//
+// Results are returned in the order of hrefs. The first error cancels the
+// remaining fetches and is returned, except that unless c.Strict is set a
+// *ParseError only drops its document and is reported in parseErrors.
+func (c *Client) fetchAllServiceMetadata(ctx context.Context, hrefs []string) (services []ServiceMetadata, parseErrors []string, err error) {
+	workers := c.MaxConcurrentFetches
+	if workers < 1 {
+		workers = 1
+	}
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*ServiceMetadata, len(hrefs))
+	sem := make(chan struct{}, workers)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		mu       sync.Mutex
+	)
+	for i, href := range hrefs {
+		wg.Add(1)
+		go func(i int, href string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-fetchCtx.Done():
+				return
+			}
+
+			metadata, err := c.fetchServiceMetadata(fetchCtx, href)
+			var parseErr *ParseError
+			if !c.Strict && errors.As(err, &parseErr) {
+				mu.Lock()
+				parseErrors = append(parseErrors, err.Error())
+				mu.Unlock()
+				return
+			}
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = metadata
+		}(i, href)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, metadata := range results {
+		if metadata != nil {
+			services = append(services, *metadata)
+		}
+	}
+	sort.Strings(parseErrors)
+	return services, parseErrors, nil
+}
+
+// DocumentMetadata fetches the ServiceMetadata for a single document type,
+// or returns nil if the participant doesn't support it
+//
+// A full document identifier (including the "##" customization part) is
+// queried directly at its own SMP URL, which takes one request. Shorter
+// identifiers such as BISBillingInvoice can't be addressed directly, so the
+// ServiceGroup is enumerated to find a matching document type first.
+func (c *Client) DocumentMetadata(ctx context.Context, icd, identifier, docType string) (*ServiceMetadata, error) {
+	smpHostname, err := c.smlLookup(ctx, icd, identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(docType, "##") {
+		return c.directDocumentMetadata(ctx, SMPHostURL(smpHostname), icd, identifier, docType)
+	}
+
+	hrefs, _, err := c.fetchServiceGroup(ctx, SMPHostURL(smpHostname), icd, identifier)
+	if err != nil {
+		return nil, err
+	}
+	return c.listedDocumentMetadata(ctx, hrefs, docType)
+}
+
+// directDocumentMetadata fetches the ServiceMetadata of a full document
+// identifier from its own URL, returning nil if the SMP has none or, with
+// ActiveOnly, none of its endpoints is active
+func (c *Client) directDocumentMetadata(ctx context.Context, baseURL, icd, identifier, docType string) (*ServiceMetadata, error) {
+	metadata, err := c.fetchServiceMetadata(ctx, c.serviceMetadataURL(baseURL, icd, identifier, docType))
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.liveMetadata(metadata), nil
+}
+
+// listedDocumentMetadata fetches the ServiceMetadata of the first of a
+// ServiceGroup's hrefs that matches docType, returning nil if none does or,
+// with ActiveOnly, none of its endpoints is active
+func (c *Client) listedDocumentMetadata(ctx context.Context, hrefs []string, docType string) (*ServiceMetadata, error) {
+	for _, href := range hrefs {
+		if published, ok := documentTypeFromHref(href); ok && DocumentTypeMatches(published, docType) {
+			metadata, err := c.fetchServiceMetadata(ctx, href)
+			if err != nil {
+				return nil, err
+			}
+			return c.liveMetadata(metadata), nil
+		}
+	}
+	return nil, nil
+}
+
+// liveMetadata applies ActiveOnly to m: it returns a copy of m with only the
+// endpoints active now, or nil if there are none. Without ActiveOnly, m is
+// returned as it is.
+func (c *Client) liveMetadata(m *ServiceMetadata) *ServiceMetadata {
+	if !c.ActiveOnly || m == nil {
+		return m
+	}
+	now := time.Now()
+	live := *m
+	live.Processes = nil
+	for _, process := range m.Processes {
+		var endpoints []Endpoint
+		for _, e := range process.Endpoints {
+			if e.IsActive(now) {
+				endpoints = append(endpoints, e)
+			}
+		}
+		if len(endpoints) > 0 {
+			live.Processes = append(live.Processes, Process{ID: process.ID, Endpoints: endpoints})
+		}
+	}
+	if len(live.Processes) == 0 {
+		return nil
+	}
+	return &live
+}
+
+// liveHrefs applies ActiveOnly to a ServiceGroup's hrefs, keeping those
+// whose ServiceMetadata has an active endpoint. Without ActiveOnly, hrefs
+// are returned as they are, without fetching anything.
+func (c *Client) liveHrefs(ctx context.Context, hrefs []string) ([]string, error) {
+	if !c.ActiveOnly {
+		return hrefs, nil
+	}
+	services, _, err := c.fetchAllServiceMetadata(ctx, hrefs)
+	if err != nil {
+		return nil, err
+	}
+	var live []string
+	for _, href := range hrefs {
+		docType, ok := documentTypeFromHref(href)
+		if !ok {
+			continue
+		}
+		for i := range services {
+			if strings.EqualFold(services[i].DocumentType, docType) && c.liveMetadata(&services[i]) != nil {
+				live = append(live, href)
+				break
+			}
+		}
+	}
+	return live, nil
+}
+
+// LookupViaSMP fetches a participant's full capabilities from the SMP at
+// smpBaseURL without consulting the SML, e.g. to test a new SMP before its
+// SML registration has propagated
+//
+// smpBaseURL must be an absolute http or https URL such as
+// "https://smp.example.com" or "https://example.com/smp"; participant paths
+// are appended to it.
+func (c *Client) LookupViaSMP(ctx context.Context, smpBaseURL, icd, identifier string) (*FullCapabilities, error) {
+	base, host, err := parseSMPBaseURL(smpBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.capabilitiesAt(ctx, base, host, icd, identifier)
+}
+
+// parseSMPBaseURL validates an SMP base URL and returns it in ASCII form
+// without a trailing slash, along with its hostname
+func parseSMPBaseURL(smpBaseURL string) (base, host string, err error) {
+	u, err := url.Parse(smpBaseURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid SMP base URL %q: %v", smpBaseURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", fmt.Errorf("invalid SMP base URL %q: expected http(s)://host[/path]", smpBaseURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", "", fmt.Errorf("invalid SMP base URL %q: must not have a query or fragment", smpBaseURL)
+	}
+	base, err = asciiURL(strings.TrimSuffix(u.String(), "/"))
+	if err != nil {
+		return "", "", err
+	}
+	return base, u.Hostname(), nil
+}
+
+// SMPServiceURL builds the URL of the ServiceMetadata for docTypeID on the
+// SMP at smpBase, escaping the participant and document identifiers as
+// whole path segments:
+//
+//	<smpBase>/<scheme>::<icd>:<identifier>/services/busdox-docid-qns::<docTypeID>
+//
+// docTypeID is a full document identifier such as BISOrderID, with
+// or without its "busdox-docid-qns::" scheme. smpBase is validated as in
+// LookupViaSMP.
+func (c *Client) SMPServiceURL(smpBase, icd, identifier, docTypeID string) (string, error) {
+	base, _, err := parseSMPBaseURL(smpBase)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(icd) == "" || strings.TrimSpace(identifier) == "" {
+		return "", fmt.Errorf("invalid participant ID %q", icd+":"+identifier)
+	}
+	docTypeID = strings.TrimPrefix(strings.TrimSpace(docTypeID), "busdox-docid-qns::")
+	if docTypeID == "" {
+		return "", errors.New("empty document type identifier")
+	}
+	return c.serviceMetadataURL(base, icd, identifier, docTypeID), nil
+}
+
+// SMPServiceURL calls DefaultClient.SMPServiceURL
+func SMPServiceURL(smpBase, icd, identifier, docTypeID string) (string, error) {
+	return DefaultClient.SMPServiceURL(smpBase, icd, identifier, docTypeID)
+}
+
+// capabilitiesAt builds a participant's full capabilities from the SMP at
+// baseURL, served under smpHostname
+func (c *Client) capabilitiesAt(ctx context.Context, baseURL, smpHostname, icd, identifier string) (*FullCapabilities, error) {
+	debug := &DebugInfo{}
+	hrefs, version, err := c.fetchServiceGroup(withDebugInfo(ctx, debug), baseURL, icd, identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	warnings = append(warnings, c.serviceGroupWarnings(debug, icd, identifier)...)
+	if c.MaxDocumentTypes > 0 && len(hrefs) > c.MaxDocumentTypes {
+		warnings = append(warnings, fmt.Sprintf("SMP lists %d document types; only the first %d were fetched",
+			len(hrefs), c.MaxDocumentTypes))
+		hrefs = hrefs[:c.MaxDocumentTypes]
+	}
+
+	services, parseErrors, err := c.fetchAllServiceMetadata(ctx, hrefs)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ActiveOnly {
+		active := services[:0]
+		for i := range services {
+			if live := c.liveMetadata(&services[i]); live != nil {
+				active = append(active, *live)
+			}
+		}
+		services = active
+	}
+
+	for _, service := range services {
+		for _, process := range service.Processes {
+			for _, e := range process.Endpoints {
+				switch {
+				case e.CertExpired:
+					warnings = append(warnings, fmt.Sprintf("%s endpoint certificate for %s expired %d days ago",
+						e.TransportProfile, friendlyDocumentName(service.DocumentType), -e.CertExpiresInDays))
+				case e.CertExpiringSoon:
+					warnings = append(warnings, fmt.Sprintf("%s endpoint certificate for %s expires in %d days",
+						e.TransportProfile, friendlyDocumentName(service.DocumentType), e.CertExpiresInDays))
+				}
+			}
+		}
+	}
+
+	return &FullCapabilities{
+		ParticipantID: fmt.Sprintf("%s:%s", icd, identifier),
+		SMPHostname:   smpHostname,
+		Services:      services,
+		Errors:        parseErrors,
+		Warnings:      warnings,
+		ByProcess:     groupByProcess(services),
+		SMPVersion:    version,
+	}, nil
+}
+
+// groupByProcess maps each process identifier to the document types served
+// under it, in the order of services
+func groupByProcess(services []ServiceMetadata) map[string][]DocumentType {
+	byProcess := make(map[string][]DocumentType)
+	for _, service := range services {
+		docType := ParseDocumentType(service.DocumentType)
+		seen := make(map[string]bool)
+		for _, process := range service.Processes {
+			if seen[process.ID] {
+				continue
+			}
+			seen[process.ID] = true
+			byProcess[process.ID] = append(byProcess[process.ID], docType)
+		}
+	}
+	return byProcess
+}
+
+// DocumentTypesViaSMP gets the document identifiers, without their
+// customization, that a participant's ServiceGroup lists on the SMP at
+// smpBaseURL (see LookupViaSMP), without consulting the SML
+//
+// The SMP is like a business card in the PEPPOL network. It tells us:
+// 1. What types of documents the participant can receive
+// 2. Technical details needed for sending documents
+// 3. Specific document format versions they support
+//
+// This is similar to how DNS MX records tell you where to send email,
+// but SMP also includes what "types" of messages you can send.
+//
+// Returns a *NotFoundError matching ErrNoDocuments if the participant is
+// registered but publishes no document types.
+func (c *Client) DocumentTypesViaSMP(ctx context.Context, smpBaseURL, icd, identifier string) ([]string, error) {
+	base, _, err := parseSMPBaseURL(smpBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	hrefs, _, err := c.fetchServiceGroup(ctx, base, icd, identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract document types from ServiceMetadataReference href attributes
+	documentTypes := make([]string, 0)
+
+	for _, ref := range hrefs {
+		if docType, ok := documentTypeFromHref(ref); ok {
+			documentTypes = append(documentTypes, strings.Split(docType, "#")[0])
+		}
+	}
+
+	return documentTypes, nil
+}
+
+// documentTypeFromHref extracts the full document identifier, including
+// its customization, from a ServiceMetadataReference href
+func documentTypeFromHref(ref string) (string, bool) {
+	href, err := url.QueryUnescape(ref)
+	if err != nil {
+		return "", false
+	}
+	if strings.Contains(href, "busdox-docid-qns::") {
+		return strings.Split(href, "busdox-docid-qns::")[1], true
+	}
+	// Other document identifier schemes, e.g. SMP 2.0's
+	// "peppol-doctype-wildcard", in a ".../services/scheme::id" URL
+	if _, service, ok := strings.Cut(href, "/services/"); ok {
+		if _, docType, ok := strings.Cut(service, "::"); ok {
+			return docType, true
+		}
+	}
+	return "", false
+}
+
+// fullDocumentTypes resolves a participant and returns the full document
+// identifiers listed in their ServiceGroup. With ActiveOnly, liveHrefs
+// fetches every ServiceMetadata document to filter them.
+func (c *Client) fullDocumentTypes(ctx context.Context, icd, identifier string) ([]string, error) {
+	smpHostname, err := c.smlLookup(ctx, icd, identifier)
+	if err != nil {
+		return nil, err
+	}
+	hrefs, _, err := c.fetchServiceGroup(ctx, SMPHostURL(smpHostname), icd, identifier)
+	if err != nil {
+		return nil, err
+	}
+	if hrefs, err = c.liveHrefs(ctx, hrefs); err != nil {
+		return nil, err
+	}
+	documentTypes := make([]string, 0, len(hrefs))
+	for _, ref := range hrefs {
+		if docType, ok := documentTypeFromHref(ref); ok {
+			documentTypes = append(documentTypes, docType)
+		}
+	}
+	return documentTypes, nil
+}
@@ -0,0 +1,237 @@
+package peppollookup
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// StructureError lists the ways CheckSMPStructure found an SMP document's
+// structure to deviate from the SMP schema
+type StructureError struct {
+	Problems []string // e.g. "/ServiceGroup: missing <ParticipantIdentifier>"
+}
+
+func (e *StructureError) Error() string {
+	return "structure check failed: " + strings.Join(e.Problems, "; ")
+}
+
+// xmlNode is a generic XML element tree
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []xmlNode  `xml:",any"`
+}
+
+// schemaElement is an element declaration of the SMP schema: its required
+// attributes, the content model of its children and the type of its text
+type schemaElement struct {
+	name     string
+	attrs    []string
+	children []schemaParticle
+	choice   bool               // children are alternatives (xs:choice), not a sequence
+	any      bool               // content is not checked (xs:any)
+	text     func(string) error // checks simple content, if set
+}
+
+// schemaParticle is a child element with its occurrence bounds
+type schemaParticle struct {
+	elem     *schemaElement
+	min, max int // max -1 means unbounded
+}
+
+// XSD simple types used by the SMP schema
+func xsdBoolean(s string) error {
+	if s != "true" && s != "false" && s != "1" && s != "0" {
+		return fmt.Errorf("%q is not an xs:boolean", s)
+	}
+	return nil
+}
+
+func xsdDateTime(s string) error {
+	_, err := parseXSDDateTime(s)
+	return err
+}
+
+func xsdBase64Binary(s string) error {
+	if _, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), "")); err != nil {
+		return fmt.Errorf("not xs:base64Binary: %v", err)
+	}
+	return nil
+}
+
+func xsdAnyURI(s string) error {
+	if _, err := url.Parse(s); err != nil {
+		return fmt.Errorf("%q is not an xs:anyURI", s)
+	}
+	return nil
+}
+
+// smpSchemas maps the root namespaces of SMP 1.0 documents to the
+// declarations of their ServiceGroup, SignedServiceMetadata and
+// ServiceMetadata elements
+//
+// The content models are transcribed from the PEPPOL (busdox) and OASIS
+// BDXR 1.0 XSDs, since the standard library has no XSD validator. They
+// check element order, occurrences, required attributes and the types of
+// simple content; namespaces are only checked on the root element.
+var smpSchemas = func() map[string][]*schemaElement {
+	el := func(name string, children ...schemaParticle) *schemaElement {
+		return &schemaElement{name: name, children: children}
+	}
+	one := func(e *schemaElement) schemaParticle { return schemaParticle{e, 1, 1} }
+	optional := func(e *schemaElement) schemaParticle { return schemaParticle{e, 0, 1} }
+	many := func(e *schemaElement, min int) schemaParticle { return schemaParticle{e, min, -1} }
+	typed := func(name string, text func(string) error) *schemaElement {
+		return &schemaElement{name: name, text: text}
+	}
+	identifier := func(name string) *schemaElement {
+		return &schemaElement{name: name, attrs: []string{"scheme"}}
+	}
+
+	schemas := make(map[string][]*schemaElement)
+	for _, oasis := range []bool{false, true} {
+		extension := &schemaElement{name: "Extension", any: true}
+		extensions := optional(extension)
+		address := one(&schemaElement{name: "EndpointReference", any: true})
+		if oasis {
+			// BDXR allows repeated extensions and a plain EndpointURI
+			extensions = many(extension, 0)
+			address = one(typed("EndpointURI", xsdAnyURI))
+		}
+
+		references := el("ServiceMetadataReferenceCollection",
+			many(&schemaElement{name: "ServiceMetadataReference", attrs: []string{"href"}}, 0))
+		serviceGroup := el("ServiceGroup", one(identifier("ParticipantIdentifier")), one(references), extensions)
+
+		endpoint := el("Endpoint",
+			address,
+			one(typed("RequireBusinessLevelSignature", xsdBoolean)),
+			optional(el("MinimumAuthenticationLevel")),
+			optional(typed("ServiceActivationDate", xsdDateTime)),
+			optional(typed("ServiceExpirationDate", xsdDateTime)),
+			one(typed("Certificate", xsdBase64Binary)),
+			one(el("ServiceDescription")),
+			one(typed("TechnicalContactUrl", xsdAnyURI)),
+			optional(typed("TechnicalInformationUrl", xsdAnyURI)),
+			extensions)
+		endpoint.attrs = []string{"transportProfile"}
+		process := el("Process",
+			one(identifier("ProcessIdentifier")),
+			one(el("ServiceEndpointList", many(endpoint, 1))),
+			extensions)
+		information := el("ServiceInformation",
+			one(identifier("ParticipantIdentifier")),
+			one(identifier("DocumentIdentifier")),
+			one(el("ProcessList", many(process, 1))),
+			extensions)
+		redirect := el("Redirect", one(el("CertificateUID")), extensions)
+		redirect.attrs = []string{"href"}
+		serviceMetadata := el("ServiceMetadata", one(information), one(redirect))
+		serviceMetadata.choice = true
+		signed := el("SignedServiceMetadata", one(serviceMetadata), one(&schemaElement{name: "Signature", any: true}))
+
+		namespace := "http://busdox.org/serviceMetadata/publishing/1.0/"
+		if oasis {
+			namespace = "http://docs.oasis-open.org/bdxr/ns/SMP/2016/05"
+		}
+		schemas[namespace] = []*schemaElement{serviceGroup, signed, serviceMetadata}
+	}
+	return schemas
+}()
+
+// validate appends the ways n deviates from e to problems
+func (e *schemaElement) validate(n *xmlNode, path string, problems *[]string) {
+	path += "/" + n.XMLName.Local
+	for _, attr := range e.attrs {
+		found := false
+		for _, a := range n.Attrs {
+			found = found || a.Name.Local == attr
+		}
+		if !found {
+			*problems = append(*problems, fmt.Sprintf("%s: missing attribute %s", path, attr))
+		}
+	}
+	if e.any {
+		return
+	}
+	if e.text != nil {
+		if err := e.text(strings.TrimSpace(n.Text)); err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+
+	if e.choice {
+		var names []string
+		for _, p := range e.children {
+			names = append(names, "<"+p.elem.name+">")
+		}
+		if len(n.Children) != 1 {
+			*problems = append(*problems, fmt.Sprintf("%s: expected exactly one of %s", path, strings.Join(names, ", ")))
+			return
+		}
+		for _, p := range e.children {
+			if n.Children[0].XMLName.Local == p.elem.name {
+				p.elem.validate(&n.Children[0], path, problems)
+				return
+			}
+		}
+		*problems = append(*problems, fmt.Sprintf("%s: unexpected <%s>, expected one of %s",
+			path, n.Children[0].XMLName.Local, strings.Join(names, ", ")))
+		return
+	}
+
+	i := 0
+	for _, p := range e.children {
+		count := 0
+		for i < len(n.Children) && n.Children[i].XMLName.Local == p.elem.name && (p.max < 0 || count < p.max) {
+			p.elem.validate(&n.Children[i], path, problems)
+			i++
+			count++
+		}
+		if count < p.min {
+			*problems = append(*problems, fmt.Sprintf("%s: missing <%s>", path, p.elem.name))
+		}
+	}
+	for ; i < len(n.Children); i++ {
+		*problems = append(*problems, fmt.Sprintf("%s: unexpected <%s>", path, n.Children[i].XMLName.Local))
+	}
+}
+
+// CheckSMPStructure checks the structure of an SMP 1.0 ServiceGroup,
+// SignedServiceMetadata or ServiceMetadata document against content
+// models transcribed from the PEPPOL or OASIS BDXR 1.0 schema, chosen by
+// its root namespace, and returns a *StructureError listing every deviation
+// found. SMP 2.0 documents are not checked.
+//
+// It is a structural check, not schema validation: it checks element
+// order and occurrences, required attributes and some simple types (see
+// smpSchemas), so a document that passes may still not conform to the
+// schema.
+func CheckSMPStructure(doc []byte) error {
+	var root xmlNode
+	if err := xml.Unmarshal(doc, &root); err != nil {
+		return err
+	}
+	if smpVersion(root.XMLName) == "2.0" {
+		return nil
+	}
+	roots, ok := smpSchemas[root.XMLName.Space]
+	if !ok {
+		return &StructureError{Problems: []string{fmt.Sprintf("<%s>: namespace %q is not an SMP namespace", root.XMLName.Local, root.XMLName.Space)}}
+	}
+	for _, e := range roots {
+		if e.name == root.XMLName.Local {
+			var problems []string
+			e.validate(&root, "", &problems)
+			if len(problems) > 0 {
+				return &StructureError{Problems: problems}
+			}
+			return nil
+		}
+	}
+	return &StructureError{Problems: []string{fmt.Sprintf("<%s> is not an SMP document element", root.XMLName.Local)}}
+}
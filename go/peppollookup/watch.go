@@ -0,0 +1,255 @@
+package peppollookup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangeEvent describes one change in a participant's PEPPOL setup seen by
+// the watch command
+type ChangeEvent struct {
+	Time          time.Time `json:"time"`
+	ParticipantID string    `json:"participant_id"`
+
+	// Type is one of "registered", "unregistered", "document_type_added",
+	// "document_type_removed", "endpoint_added", "endpoint_removed",
+	// "certificate_changed" or "lookup_failed"
+	Type             string `json:"type"`
+	DocumentType     string `json:"document_type,omitempty"`
+	Process          string `json:"process,omitempty"`
+	TransportProfile string `json:"transport_profile,omitempty"`
+	Detail           string `json:"detail,omitempty"`
+}
+
+// watchEndpoint is what the watch command tracks about an endpoint
+type watchEndpoint struct {
+	Address     string
+	Fingerprint string // SHA-256 of the certificate, or of its text if unparseable
+}
+
+// watchKey identifies an endpoint within a document type. A transport
+// profile alone isn't enough: each process can publish its own endpoint
+// for it.
+type watchKey struct {
+	Process          string
+	TransportProfile string
+}
+
+// watchState maps document types to their endpoints by process and
+// transport profile; nil means the participant isn't registered or
+// publishes nothing
+type watchState map[string]map[watchKey]watchEndpoint
+
+// newWatchState extracts the tracked parts of a participant's
+// capabilities, or returns nil if capabilities is nil
+func newWatchState(capabilities *FullCapabilities) watchState {
+	if capabilities == nil {
+		return nil
+	}
+	state := make(watchState)
+	for _, service := range capabilities.Services {
+		endpoints := make(map[watchKey]watchEndpoint)
+		for _, process := range service.Processes {
+			for _, e := range process.Endpoints {
+				fingerprint := sha256.Sum256([]byte(e.Certificate))
+				if cert, err := e.ParseCertificate(); err == nil {
+					fingerprint = sha256.Sum256(cert.Raw)
+				}
+				endpoints[watchKey{process.ID, string(e.TransportProfile)}] = watchEndpoint{Address: e.Address, Fingerprint: hex.EncodeToString(fingerprint[:])}
+			}
+		}
+		state[service.DocumentType] = endpoints
+	}
+	return state
+}
+
+// DiffCapabilities returns the changes in a participant's setup from old to
+// current, as the watch command reports them: document types added or
+// removed, endpoints added, removed or moved, and certificate rotations.
+// nil stands for a participant who isn't registered or publishes nothing.
+func DiffCapabilities(old, current *FullCapabilities) []ChangeEvent {
+	return diffWatchStates(newWatchState(old), newWatchState(current))
+}
+
+// diffWatchStates returns the changes from old to current, ordered by
+// document type, process and transport profile
+func diffWatchStates(old, current watchState) []ChangeEvent {
+	var events []ChangeEvent
+	switch {
+	case old == nil && current != nil:
+		events = append(events, ChangeEvent{Type: "registered"})
+	case old != nil && current == nil:
+		events = append(events, ChangeEvent{Type: "unregistered"})
+	}
+
+	docTypes := make(map[string]bool)
+	for docType := range old {
+		docTypes[docType] = true
+	}
+	for docType := range current {
+		docTypes[docType] = true
+	}
+	for _, docType := range sortedKeys(docTypes) {
+		before, hadBefore := old[docType]
+		after, hasAfter := current[docType]
+		switch {
+		case !hadBefore:
+			events = append(events, ChangeEvent{Type: "document_type_added", DocumentType: docType})
+		case !hasAfter:
+			events = append(events, ChangeEvent{Type: "document_type_removed", DocumentType: docType})
+			continue
+		}
+
+		keys := make(map[watchKey]bool)
+		for key := range before {
+			keys[key] = true
+		}
+		for key := range after {
+			keys[key] = true
+		}
+		for _, key := range sortedWatchKeys(keys) {
+			b, hadEndpoint := before[key]
+			a, hasEndpoint := after[key]
+			event := ChangeEvent{DocumentType: docType, Process: key.Process, TransportProfile: key.TransportProfile}
+			switch {
+			case !hadEndpoint:
+				event.Type, event.Detail = "endpoint_added", a.Address
+			case !hasEndpoint:
+				event.Type, event.Detail = "endpoint_removed", b.Address
+			case a.Address != b.Address:
+				event.Type, event.Detail = "endpoint_removed", b.Address
+				events = append(events, event)
+				event.Type, event.Detail = "endpoint_added", a.Address
+			case a.Fingerprint != b.Fingerprint:
+				event.Type, event.Detail = "certificate_changed", b.Fingerprint+" -> "+a.Fingerprint
+			default:
+				continue
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// CapabilityDiff is the change in a participant's setup between two
+// CapabilityReports, as computed by Delta
+type CapabilityDiff struct {
+	ParticipantID string    `json:"participant_id"`
+	From          time.Time `json:"from"` // GeneratedAt of the old report
+	To            time.Time `json:"to"`   // GeneratedAt of the new report
+
+	// Changes are ordered by document type, process and transport profile,
+	// with the
+	// same Types as the watch command reports, except "lookup_failed"
+	Changes []ChangeEvent `json:"changes"`
+}
+
+// Delta compares two reports of the same participant, e.g. snapshots taken
+// at different times, and returns the document types added or removed,
+// endpoints added, removed or moved, and certificate rotations
+func Delta(old, current CapabilityReport) CapabilityDiff {
+	diff := CapabilityDiff{
+		ParticipantID: current.ParticipantID,
+		From:          old.GeneratedAt,
+		To:            current.GeneratedAt,
+		Changes:       []ChangeEvent{},
+	}
+	for _, event := range diffWatchStates(reportWatchState(old), reportWatchState(current)) {
+		event.Time = current.GeneratedAt
+		event.ParticipantID = current.ParticipantID
+		diff.Changes = append(diff.Changes, event)
+	}
+	return diff
+}
+
+// reportWatchState is newWatchState for a CapabilityReport
+func reportWatchState(report CapabilityReport) watchState {
+	if !report.Registered {
+		return nil
+	}
+	state := make(watchState)
+	for _, docType := range report.DocumentTypes {
+		state[docType] = make(map[watchKey]watchEndpoint)
+	}
+	for _, e := range report.Endpoints {
+		if state[e.DocumentType] == nil {
+			state[e.DocumentType] = make(map[watchKey]watchEndpoint)
+		}
+		state[e.DocumentType][watchKey{e.Process, string(e.TransportProfile)}] = watchEndpoint{Address: e.Address, Fingerprint: e.CertificateFingerprint}
+	}
+	return state
+}
+
+// String renders the diff as a changelog entry: a heading with the
+// participant and date, then one line per change
+func (d CapabilityDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, %s\n", d.ParticipantID, d.To.Format("2006-01-02"))
+	if len(d.Changes) == 0 {
+		b.WriteString("- No changes\n")
+	}
+	for _, event := range d.Changes {
+		fmt.Fprintf(&b, "- %s\n", changelogLine(event))
+	}
+	return b.String()
+}
+
+// changelogLine describes a ChangeEvent in words
+func changelogLine(event ChangeEvent) string {
+	doc := friendlyDocumentName(event.DocumentType)
+	switch event.Type {
+	case "registered":
+		return "Registered in the SML"
+	case "unregistered":
+		return "No longer registered in the SML"
+	case "document_type_added":
+		return fmt.Sprintf("Added %s (%s)", doc, event.DocumentType)
+	case "document_type_removed":
+		return fmt.Sprintf("Removed %s (%s)", doc, event.DocumentType)
+	case "endpoint_added":
+		return fmt.Sprintf("Added %s endpoint %s for %s%s", event.TransportProfile, event.Detail, doc, processSuffix(event.Process))
+	case "endpoint_removed":
+		return fmt.Sprintf("Removed %s endpoint %s for %s%s", event.TransportProfile, event.Detail, doc, processSuffix(event.Process))
+	case "certificate_changed":
+		return fmt.Sprintf("Rotated %s certificate for %s%s: %s", event.TransportProfile, doc, processSuffix(event.Process), event.Detail)
+	}
+	return strings.TrimSpace(event.Type + " " + event.Detail)
+}
+
+// processSuffix names a process in a changelog line, if there is one
+func processSuffix(process string) string {
+	if process == "" {
+		return ""
+	}
+	return " (process " + process + ")"
+}
+
+// sortedKeys returns the keys of set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedWatchKeys returns the keys of set ordered by process, then
+// transport profile
+func sortedWatchKeys(set map[watchKey]bool) []watchKey {
+	keys := make([]watchKey, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Process != keys[j].Process {
+			return keys[i].Process < keys[j].Process
+		}
+		return keys[i].TransportProfile < keys[j].TransportProfile
+	})
+	return keys
+}
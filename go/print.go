@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/snapbooks-app/peppol-lookup/go/internal/parallel"
+
+	"github.com/snapbooks-app/peppol-lookup/go/peppollookup"
+)
+
+// colorEnabled is set when stdout is a terminal and NO_COLOR is not set
+var colorEnabled = func() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}()
+
+// colorize wraps s in an ANSI color escape when color output is enabled
+func colorize(s, code string) string {
+	if !colorEnabled {
+		return s
+	}
+	return "\033[" + code + "m" + s + "\033[0m"
+}
+
+func green(s string) string { return colorize(s, "32") }
+func red(s string) string   { return colorize(s, "31") }
+
+// runAssertions checks each "participant-id expected-document-type" line in
+// path and prints a pass/fail table. Blank lines and lines starting with #
+// are skipped. It reports whether every assertion passed.
+func runAssertions(ctx context.Context, client *peppollookup.Client, path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Document types per participant, so each SMP is only queried once
+	supported := make(map[peppollookup.ParticipantID][]peppollookup.DocumentType)
+	lookupErrs := make(map[peppollookup.ParticipantID]error)
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PARTICIPANT\tDOCUMENT TYPE\tRESULT")
+
+	allPassed := true
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return false, fmt.Errorf("%s:%d: expected \"participant-id document-type\"", path, lineNo)
+		}
+		id, err := peppollookup.ParseParticipantID(fields[0])
+		if err != nil {
+			return false, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		expected := fields[1]
+
+		documentTypes, seen := supported[id]
+		if !seen && lookupErrs[id] == nil {
+			documentTypes, err = client.DocumentTypes(ctx, id)
+			if err != nil {
+				lookupErrs[id] = err
+			}
+			supported[id] = documentTypes
+		}
+
+		result := "FAIL"
+		if err := lookupErrs[id]; err != nil {
+			result = fmt.Sprintf("FAIL (%v)", err)
+		} else {
+			for _, docType := range documentTypes {
+				if peppollookup.DocumentTypeMatches(docType.Raw, expected) {
+					result = "PASS"
+					break
+				}
+			}
+		}
+		if result != "PASS" {
+			allPassed = false
+			result = red(result)
+		} else {
+			result = green(result)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", id, expected, result)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return allPassed, table.Flush()
+}
+
+// cliOptions holds the command-line flags that affect single lookups
+type cliOptions struct {
+	dumpPath    string
+	snapshotDir string
+	offline     bool
+	smpHost     string // query this SMP directly instead of resolving via the SML
+
+	// checkEndpoints connects to each access point after the lookup
+	checkEndpoints bool
+}
+
+// printLookup looks up one participant and writes what they support to w,
+// and errors and warnings to errw. It returns why the lookup failed, or nil.
+func printLookup(ctx context.Context, w, errw io.Writer, client *peppollookup.Client, id peppollookup.ParticipantID, opts cliOptions) error {
+	icd, identifier := id.ICD, id.Identifier
+
+	var result *peppollookup.Result
+	var err error
+	if opts.offline {
+		var takenAt time.Time
+		result, takenAt, err = loadSnapshot(opts.snapshotDir, id.String(), time.Now())
+		if err == nil {
+			fmt.Fprintf(w, "Using snapshot from %s\n", takenAt.Format(time.RFC3339))
+		}
+	} else if opts.smpHost != "" {
+		var documentTypes []string
+		documentTypes, err = client.DocumentTypesViaSMP(ctx, peppollookup.SMPHostURL(opts.smpHost), icd, identifier)
+		result = &peppollookup.Result{ParticipantID: id.String(), SMPHostname: opts.smpHost, DNSName: client.DNSName(icd, identifier), DocumentTypes: documentTypes}
+	} else {
+		// Use SML to find where participant's metadata is hosted, then
+		// query their SMP to discover supported documents
+		result, err = client.Lookup(ctx, icd, identifier)
+	}
+	if errors.Is(err, peppollookup.ErrNotRegistered) {
+		fmt.Fprintln(w, red(fmt.Sprintf("Not a PEPPOL participant: %s:%s", icd, identifier)))
+		fmt.Fprintf(w, "DNS name: %s\n", client.DNSName(icd, identifier))
+		printProductionWarning(errw, err)
+		if alternate, ok := peppollookup.NorwegianAlternate(id); ok {
+			fmt.Fprintf(w, "Norwegian participants may be registered under either scheme; try %s\n", alternate)
+		}
+		return err
+	}
+	if errors.Is(err, peppollookup.ErrNoDocuments) {
+		fmt.Fprintln(w, red(fmt.Sprintf("Registered, but no document types published: %s:%s", icd, identifier)))
+		return err
+	}
+	if err != nil {
+		fmt.Fprintf(errw, "Error: %v\n", err)
+		return err
+	}
+
+	if opts.snapshotDir != "" && !opts.offline {
+		path, err := saveSnapshot(opts.snapshotDir, result, time.Now())
+		if err != nil {
+			fmt.Fprintf(errw, "Error: %v\n", err)
+			return err
+		}
+		fmt.Fprintf(w, "Snapshot saved to %s\n", path)
+	}
+
+	fmt.Fprintf(w, "SMP hostname: %s\n", result.SMPHostname)
+	if result.DNSName != "" {
+		fmt.Fprintf(w, "DNS name: %s\n", result.DNSName)
+	}
+	documentTypes := result.DocumentTypes
+
+	fmt.Fprintln(w, "\nSupported document identifiers:")
+	for _, docType := range documentTypes {
+		fmt.Fprintf(w, "- %s\n", docType)
+	}
+
+	// Check for PEPPOL BIS Billing 3.0 documents
+	fmt.Fprintln(w, "\nPEPPOL BIS Billing 3.0 Support:")
+	for _, docType := range documentTypes {
+		switch docType {
+		case peppollookup.BISBillingInvoice:
+			fmt.Fprintln(w, green("- Supports Invoice"))
+		case peppollookup.BISBillingCreditNote:
+			fmt.Fprintln(w, green("- Supports Credit Note"))
+		}
+	}
+
+	if len(result.NationalProfiles) > 0 {
+		fmt.Fprintln(w, "\nNational profiles:")
+		for _, profile := range result.NationalProfiles {
+			fmt.Fprintln(w, green(fmt.Sprintf("- Supports %s (%s)", profile.Name, profile.Country)))
+		}
+	}
+
+	if result.Debug != nil && len(result.Debug.CNAMEChain) > 1 {
+		fmt.Fprintf(w, "\nCNAME chain: %s\n", strings.Join(result.Debug.CNAMEChain, " -> "))
+	}
+
+	if result.Debug != nil && len(result.Debug.DNSAnswers) > 0 {
+		fmt.Fprintln(w, "\nDNS answers:")
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, record := range result.Debug.DNSAnswers {
+			fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", record.Name, record.TTL, record.Type, record.Value)
+		}
+		table.Flush()
+	}
+
+	if client.DebugDNS && result.Debug != nil && len(result.Debug.TLSCertificates) > 0 {
+		fmt.Fprintln(w, "\nSMP TLS certificates:")
+		for _, cert := range result.Debug.TLSCertificates {
+			fmt.Fprintf(w, "- %s\n  issuer: %s\n  expires: %s\n", cert.Subject, cert.Issuer, cert.NotAfter.Format("2006-01-02"))
+		}
+	}
+
+	if opts.dumpPath != "" {
+		if err := writeDump(ctx, client, icd, identifier, opts.smpHost, opts.dumpPath); err != nil {
+			fmt.Fprintf(errw, "Error: %v\n", err)
+			return err
+		}
+		fmt.Fprintf(w, "\nFull capabilities written to %s\n", opts.dumpPath)
+	}
+
+	if opts.checkEndpoints {
+		reachable, err := printEndpointReachability(ctx, w, client, icd, identifier, opts.smpHost)
+		if err != nil {
+			fmt.Fprintf(errw, "Error: %v\n", err)
+			return err
+		}
+		if !reachable {
+			return errors.New("not every endpoint is reachable")
+		}
+	}
+	return nil
+}
+
+// printLookups runs printLookup for each participant, up to concurrency at
+// a time. Each participant's output is buffered and printed in the order of
+// ids as soon as it and those before it are done. It returns the lookups
+// that failed.
+func printLookups(ctx context.Context, client *peppollookup.Client, ids []peppollookup.ParticipantID, concurrency int, opts cliOptions) []record {
+	outputs := make([]bytes.Buffer, len(ids))
+	errOutputs := make([]bytes.Buffer, len(ids))
+	errs := make([]error, len(ids))
+	done := make([]chan struct{}, len(ids))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	go parallel.ForEach(len(ids), concurrency, func(i int) {
+		errs[i] = printLookup(ctx, &outputs[i], &errOutputs[i], client, ids[i], opts)
+		close(done[i])
+	})
+
+	var failures []record
+	for i, id := range ids {
+		<-done[i]
+		if i > 0 {
+			fmt.Println()
+		}
+		os.Stdout.Write(outputs[i].Bytes())
+		os.Stderr.Write(errOutputs[i].Bytes())
+		if errs[i] != nil {
+			failures = append(failures, record{ID: id, Err: errs[i]})
+		}
+	}
+	return failures
+}
+
+// printEndpointReachability fetches the participant's endpoints and writes
+// whether each accepts connections to w. It reports whether all of them do.
+func printEndpointReachability(ctx context.Context, w io.Writer, client *peppollookup.Client, icd, identifier, smpHost string) (bool, error) {
+	var capabilities *peppollookup.FullCapabilities
+	var err error
+	if smpHost != "" {
+		capabilities, err = client.LookupViaSMP(ctx, peppollookup.SMPHostURL(smpHost), icd, identifier)
+	} else {
+		capabilities, err = client.FullCapabilities(ctx, icd, identifier)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintln(w, "\nEndpoint reachability:")
+	results := client.EndpointReachability(ctx, capabilities)
+	if len(results) == 0 {
+		fmt.Fprintln(w, red("- No endpoints published"))
+		return false, nil
+	}
+	allReachable := true
+	for _, r := range results {
+		if r.Reachable {
+			fmt.Fprintln(w, green(fmt.Sprintf("- %s (%s): reachable in %s", r.Address, r.TransportProfile, r.Latency.Round(time.Millisecond))))
+			continue
+		}
+		allReachable = false
+		fmt.Fprintln(w, red(fmt.Sprintf("- %s (%s): unreachable: %s", r.Address, r.TransportProfile, r.Error)))
+	}
+	return allReachable, nil
+}
+
+// printProductionWarning writes the Warning of a *NotFoundError to w, with
+// a hint to switch environments
+func printProductionWarning(w io.Writer, err error) {
+	var notFound *peppollookup.NotFoundError
+	if errors.As(err, &notFound) && notFound.Warning != "" {
+		fmt.Fprintf(w, "Warning: %s; use --env-name=production to look them up there\n", notFound.Warning)
+	}
+}
+
+// printRegistrations prints whether each participant is registered in the
+// SML, without querying any SMP. It returns the checks that failed.
+func printRegistrations(ctx context.Context, client *peppollookup.Client, ids []peppollookup.ParticipantID, concurrency int, filter registrationFilter) []record {
+	registered := make([]bool, len(ids))
+	errs := make([]error, len(ids))
+	parallel.ForEach(len(ids), concurrency, func(i int) {
+		registered[i], errs[i] = client.IsRegistered(ctx, ids[i].ICD, ids[i].Identifier)
+	})
+
+	var failures []record
+	for i, id := range ids {
+		switch registered, err := registered[i], errs[i]; {
+		case err != nil:
+			fmt.Printf("%s\t%s\n", id, red(fmt.Sprintf("error: %v", err)))
+			failures = append(failures, record{ID: id, Err: err})
+		case !filter.keep(registered):
+		case registered:
+			fmt.Printf("%s\t%s\n", id, green("registered"))
+		default:
+			fmt.Printf("%s\t%s\n", id, red("not registered"))
+		}
+	}
+	return failures
+}
+
+// printBatchSummary prints the lookups that failed out of total to w, so a
+// failure isn't lost in the output of a long batch. Errors already printed
+// inline may be left out of failures. It reports whether all succeeded.
+func printBatchSummary(w io.Writer, total int, failures []record) bool {
+	if len(failures) == 0 {
+		return true
+	}
+	if total > 1 {
+		fmt.Fprintf(w, "\n%d of %d lookups failed:\n", len(failures), total)
+		for _, r := range failures {
+			if r.Err != nil {
+				fmt.Fprintf(w, "  %s: %v\n", r.ID, r.Err)
+			} else {
+				fmt.Fprintf(w, "  %s\n", r.ID)
+			}
+		}
+	}
+	return false
+}
+
+// printNameMatches prints the participants ResolveByName found as a table
+func printNameMatches(w io.Writer, reports []peppollookup.CapabilityReport) error {
+	if len(reports) == 0 {
+		_, err := fmt.Fprintln(w, "No matching participants found in the PEPPOL Directory")
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PARTICIPANT\tNAME\tCOUNTRY\tREGISTERED\tINVOICE\tCREDIT NOTE")
+	for _, r := range reports {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%t\t%t\t%t\n", r.ParticipantID, r.Name, r.Country, r.Registered, r.Invoice, r.CreditNote)
+		for _, warning := range r.Warnings {
+			fmt.Fprintf(table, "\t%s\n", red("warning: "+warning))
+		}
+	}
+	return table.Flush()
+}
+
+// registrationFilter selects batch output rows by SML registration.
+// Participants whose lookup failed for another reason are always shown,
+// since their registration is unknown.
+type registrationFilter int
+
+const (
+	showAll registrationFilter = iota
+	showRegistered
+	showUnregistered
+)
+
+// keep reports whether a participant with the given registration is shown
+func (f registrationFilter) keep(registered bool) bool {
+	switch f {
+	case showRegistered:
+		return registered
+	case showUnregistered:
+		return !registered
+	}
+	return true
+}
+
+// filterRecords returns the records filter keeps
+func filterRecords(records []record, filter registrationFilter) []record {
+	kept := records[:0:0]
+	for _, r := range records {
+		failed := r.Err != nil && !r.registered() && !errors.Is(r.Err, peppollookup.ErrNotRegistered)
+		if failed || filter.keep(r.registered()) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// printSchemes prints the known ICD schemes as a table
+func printSchemes(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ICD\tCOUNTRY\tNAME")
+	for _, scheme := range peppollookup.ListSchemes() {
+		name := scheme.Name
+		if scheme.Deprecated {
+			name += " (deprecated)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", scheme.ICD, scheme.Country, name)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snapbooks-app/peppol-lookup/go/peppollookup"
+)
+
+// snapshotTimeFormat names snapshot files so they sort chronologically
+const snapshotTimeFormat = "20060102T150405Z"
+
+// snapshotDirFor returns the directory holding a participant's snapshots
+func snapshotDirFor(dir, participantID string) string {
+	return filepath.Join(dir, strings.ReplaceAll(participantID, ":", "_"))
+}
+
+// saveSnapshot writes result to dir as <participant>/<timestamp>.json and
+// returns the file path
+func saveSnapshot(dir string, result *peppollookup.Result, at time.Time) (string, error) {
+	participantDir := snapshotDirFor(dir, result.ParticipantID)
+	if err := os.MkdirAll(participantDir, 0o755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(participantDir, at.UTC().Format(snapshotTimeFormat)+".json")
+	return path, os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// loadSnapshot reads the most recent snapshot of a participant taken at or
+// before asOf, returning it with the time it was taken
+func loadSnapshot(dir, participantID string, asOf time.Time) (*peppollookup.Result, time.Time, error) {
+	entries, err := os.ReadDir(snapshotDirFor(dir, participantID))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, time.Time{}, err
+	}
+
+	var times []time.Time
+	for _, entry := range entries {
+		t, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(entry.Name(), ".json"))
+		if err == nil && !t.After(asOf) {
+			times = append(times, t)
+		}
+	}
+	if len(times) == 0 {
+		return nil, time.Time{}, fmt.Errorf("no snapshot of %s in %s", participantID, dir)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	latest := times[len(times)-1]
+
+	data, err := os.ReadFile(filepath.Join(snapshotDirFor(dir, participantID), latest.Format(snapshotTimeFormat)+".json"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var result peppollookup.Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	return &result, latest, nil
+}
+
+// writeDump saves a participant's full capabilities as indented JSON,
+// fetched from smpHost if set or else via the SML
+func writeDump(ctx context.Context, client *peppollookup.Client, icd, identifier, smpHost, path string) error {
+	var capabilities *peppollookup.FullCapabilities
+	var err error
+	if smpHost != "" {
+		capabilities, err = client.LookupViaSMP(ctx, peppollookup.SMPHostURL(smpHost), icd, identifier)
+	} else {
+		capabilities, err = client.FullCapabilities(ctx, icd, identifier)
+	}
+	if err != nil {
+		return err
+	}
+	for _, warning := range capabilities.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	data, err := json.MarshalIndent(capabilities, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}